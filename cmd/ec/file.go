@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"lxport/endpointc"
+)
+
+// fileCommands subcommands of file transfer, and their usage
+var fileCommands = map[string]string{
+	"get": "get [flags] /remote/file [local]",
+	"put": "put [flags] local /remote/file",
+	"ls":  "ls [flags] /remote/dir",
+	"sum": "sum [flags] /remote/file",
+}
+
+// runFileCommand run file transfer subcommand with device of -u,
+// return exit code
+func runFileCommand(cmd string, args []string) int {
+	flag.CommandLine.Parse(args)
+	args = flag.Args()
+
+	if uuid == "" || wsURL == "" {
+		fmt.Fprintln(os.Stderr, "please specify device uuid and websocket URL")
+		return 2
+	}
+
+	minArgs := 1
+	if cmd == "put" {
+		minArgs = 2
+	}
+	if len(args) < minArgs {
+		fmt.Fprintln(os.Stderr, "usage: ec", fileCommands[cmd])
+		return 2
+	}
+
+	// transfer output is for user, keep log quiet
+	log.SetLevel(log.WarnLevel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	client := endpointc.NewClient(wsURL)
+
+	var err error
+	switch cmd {
+	case "get":
+		local := path.Base(args[0])
+		if len(args) > 1 {
+			local = args[1]
+		}
+		err = client.GetFile(ctx, uuid, args[0], local)
+	case "put":
+		err = client.PutFile(ctx, uuid, args[0], args[1])
+	case "ls":
+		var infos []*endpointc.FileInfo
+		infos, err = client.ListFiles(ctx, uuid, args[0])
+		for _, fi := range infos {
+			mt := time.Unix(fi.ModTime, 0).Format("2006-01-02 15:04")
+			fmt.Printf("%s %12d %s %s\n", os.FileMode(fi.Mode), fi.Size, mt, fi.Name)
+		}
+	case "sum":
+		var sum string
+		_, sum, err = client.SumFile(ctx, uuid, args[0])
+		if err == nil {
+			fmt.Printf("%s  %s\n", sum, args[0])
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", cmd, err)
+		return 1
+	}
+
+	return 0
+}
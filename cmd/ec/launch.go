@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"lxport/endpointc"
+)
+
+// listenInfo listen address of a mapping, for other tooling
+type listenInfo struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	Port int    `json:"port,omitempty"`
+}
+
+// listenInfos collect listen address of all forwarders
+func listenInfos(forwarders []*endpointc.Forwarder, mappings []*endpointc.Params) []*listenInfo {
+	infos := make([]*listenInfo, 0, len(forwarders))
+	for i, f := range forwarders {
+		info := &listenInfo{
+			Name: mappings[i].Name,
+			Addr: f.Addr().String(),
+		}
+
+		if info.Name == "" {
+			info.Name = "default"
+		}
+
+		switch addr := f.Addr().(type) {
+		case *net.TCPAddr:
+			info.Port = addr.Port
+		case *net.UDPAddr:
+			info.Port = addr.Port
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// reportPorts write chosen ports to file, and to stdout as json
+func reportPorts(infos []*listenInfo, portFile string, printJSON bool) error {
+	if portFile != "" && len(infos) > 0 {
+		var lines []string
+		for _, info := range infos {
+			lines = append(lines, strconv.Itoa(info.Port))
+		}
+
+		err := ioutil.WriteFile(portFile, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if printJSON {
+		out := struct {
+			Port     int           `json:"port"`
+			Mappings []*listenInfo `json:"mappings"`
+		}{
+			Mappings: infos,
+		}
+
+		if len(infos) > 0 {
+			out.Port = infos[0].Port
+		}
+
+		b, err := json.Marshal(out)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+
+	return nil
+}
+
+// launch run command with {port} replaced by port of first mapping and
+// {portN} by port of mapping N, ports are also exported as LXPORT_PORT
+// and LXPORT_PORT_N. Wait the command to exit, return its exit code
+func launch(command string, infos []*listenInfo) (int, error) {
+	env := os.Environ()
+	for i := len(infos) - 1; i >= 0; i-- {
+		port := strconv.Itoa(infos[i].Port)
+		command = strings.Replace(command, fmt.Sprintf("{port%d}", i), port, -1)
+		env = append(env, fmt.Sprintf("LXPORT_PORT_%d=%s", i, port))
+	}
+
+	if len(infos) > 0 {
+		port := strconv.Itoa(infos[0].Port)
+		command = strings.Replace(command, "{port}", port, -1)
+		env = append(env, "LXPORT_PORT="+port)
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), nil
+		}
+		return -1, err
+	}
+
+	return 0, nil
+}
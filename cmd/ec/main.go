@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -16,16 +20,69 @@ var (
 	lport  int
 	rport  int
 	uuid   string
+	pool   string
 	wsURL  string
+	socks  string
+	hproxy string
+	stdio  bool
+	udp    bool
 	daemon = ""
+	drain  time.Duration
+
+	mappingFlags stringsFlag
+	reverseFlags stringsFlag
+	vpn          bool
+	vpnRoutes    string
+	profile      string
+	profileFile  string
+
+	bind     string
+	allow    string
+	auth     string
+	maxConns int
+
+	execCmd   string
+	portFile  string
+	printJSON bool
 )
 
 func init() {
 	flag.IntVar(&lport, "l", 8009, "specify the listen port")
 	flag.IntVar(&rport, "r", 3389, "specify target port")
 	flag.StringVar(&uuid, "u", "", "specify device uuid")
+	flag.StringVar(&pool, "pool", "", "specify device pool, instead of device uuid")
 	flag.StringVar(&wsURL, "url", "", "specify web ssh path")
+	flag.StringVar(&socks, "socks", "", "specify socks5 listen address, eg. 127.0.0.1:1080")
+	flag.StringVar(&hproxy, "http", "", "specify http proxy listen address, eg. 127.0.0.1:8080")
+	flag.BoolVar(&udp, "udp", false, "specify whether forward udp instead of tcp, for -l and -r")
+	flag.BoolVar(&stdio, "stdio", false, "bridge stdin/stdout to target port, eg. as ssh ProxyCommand")
+	flag.Var(&mappingFlags, "L", "specify port mapping lport:device:rport[/udp], can be repeated, @name as device means pool")
+	flag.Var(&reverseFlags, "R", "specify reverse mapping rport:[lhost:]lport, device of -u listen on rport, can be repeated")
+	flag.BoolVar(&vpn, "vpn", false, "specify whether start vpn to device of -u or -pool, linux only")
+	flag.StringVar(&vpnRoutes, "vpnroute", "", "specify networks in device's LAN that routed via vpn, eg. 192.168.1.0/24")
+	flag.StringVar(&profile, "profile", "", "specify profile name in profile file")
+	flag.StringVar(&profileFile, "pf", endpointc.DefaultProfilePath(), "specify profile file")
+	flag.StringVar(&bind, "b", "127.0.0.1", "specify bind address of listen port, ipv6 or unix:/path also supported")
+	flag.StringVar(&allow, "allow", "", "specify client networks that allowed to connect, eg. 10.0.0.0/8,192.168.1.5")
+	flag.StringVar(&auth, "auth", "", "specify user:password that socks5/http proxy client must provide, port forwarding use -allow instead")
+	flag.IntVar(&maxConns, "max", 0, "specify max concurrent connections of each listener, 0 means unlimited")
+	flag.StringVar(&execCmd, "exec", "", "specify command to launch after listening, {port} is replaced, exit when it exits")
+	flag.StringVar(&portFile, "portfile", "", "specify file to write listen ports to, useful with -l 0")
+	flag.BoolVar(&printJSON, "json", false, "print listen addresses to stdout as json")
 	flag.StringVar(&daemon, "d", "yes", "specify daemon mode")
+	flag.DurationVar(&drain, "drain", 30*time.Second, "specify how long to wait connections to end when exit")
+}
+
+// stringsFlag flag that can be repeated
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
 }
 
 // getVersion get version
@@ -39,6 +96,13 @@ func main() {
 
 	version := flag.Bool("v", false, "show version")
 
+	// file transfer subcommands, eg. ec get -u dev -url ws://... /var/log/syslog
+	if len(os.Args) > 1 {
+		if _, ok := fileCommands[os.Args[1]]; ok {
+			os.Exit(runFileCommand(os.Args[1], os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
 	if *version {
@@ -46,31 +110,212 @@ func main() {
 		os.Exit(0)
 	}
 
+	if stdio {
+		// stderr is shared with caller, eg. ssh, keep it quiet
+		log.SetLevel(log.WarnLevel)
+	}
+
 	log.Println("try to start  lxport endpoint client, version:", getVersion())
 
-	if uuid == "" {
-		log.Fatal("please specify target device uuid")
+	var mappings []*endpointc.Params
+	if profile != "" {
+		ms, err := endpointc.LoadProfile(profileFile, profile)
+		if err != nil {
+			log.Fatal("load profile failed:", err)
+		}
+		mappings = append(mappings, ms...)
+	}
+
+	for _, m := range mappingFlags {
+		params, err := endpointc.ParseMapping(m)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mappings = append(mappings, params)
+	}
+
+	// socks5 and http proxy listen on their own address
+	if socks != "" {
+		mappings = append(mappings, &endpointc.Params{
+			Name:  "socks5",
+			UUID:  uuid,
+			Pool:  pool,
+			Socks: socks,
+			Auth:  auth,
+		})
+	}
+
+	if hproxy != "" {
+		mappings = append(mappings, &endpointc.Params{
+			Name:      "http",
+			UUID:      uuid,
+			Pool:      pool,
+			HTTPProxy: hproxy,
+			Auth:      auth,
+		})
+	}
+
+	var reverses []*endpointc.ReverseParams
+	for _, m := range reverseFlags {
+		params, err := endpointc.ParseReverse(m)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if uuid == "" {
+			log.Fatal("please specify device uuid of reverse mapping")
+		}
+
+		params.UUID = uuid
+		params.WsURL = wsURL
+		reverses = append(reverses, params)
+	}
+
+	if len(mappings) == 0 && len(reverses) == 0 && !vpn {
+		mappings = append(mappings, &endpointc.Params{
+			LocalPort:  uint16(lport),
+			RemotePort: uint16(rport),
+			UUID:       uuid,
+			Pool:       pool,
+			UDP:        udp,
+		})
+	}
+
+	for _, params := range mappings {
+		if params.UUID == "" && params.Pool == "" && params.Socks == "" && params.HTTPProxy == "" {
+			log.Fatal("please specify target device uuid or pool")
+		}
 	}
 
-	if wsURL == "" {
+	for _, params := range mappings {
+		if params.WsURL == "" {
+			params.WsURL = wsURL
+		}
+
+		if params.WsURL == "" {
+			log.Fatal("please specify websocket URL")
+		}
+
+		if params.Bind == "" {
+			params.Bind = bind
+		}
+
+		if allow != "" {
+			params.AllowClients = strings.Split(allow, ",")
+		}
+
+		params.MaxConns = maxConns
+	}
+
+	if (len(reverses) > 0 || vpn) && wsURL == "" {
 		log.Fatal("please specify websocket URL")
 	}
 
-	params := &endpointc.Params{
-		LocalPort:  uint16(lport),
-		RemotePort: uint16(rport),
-		UUID:       uuid,
-		WsURL:      wsURL,
+	if stdio && len(mappings) == 0 {
+		log.Fatal("stdio need a mapping")
+	}
+
+	if stdio {
+		// one pair, exit when it closed
+		err := endpointc.Stdio(context.Background(), mappings[0], os.Stdin, os.Stdout)
+		if err != nil {
+			log.Fatal("lxport endpoint client stdio failed:", err)
+		}
+		return
+	}
+
+	// one forwarder for each mapping
+	var forwarders []*endpointc.Forwarder
+	for _, params := range mappings {
+		f, err := endpointc.Listen(params)
+		if err != nil {
+			log.Fatalf("endpoint client listen for %s failed: %v", params.Name, err)
+		}
+
+		// start tcp server
+		go f.Serve()
+		log.Printf("mapping %s listen:%s, target port:%d", params.Name, f.Addr(), params.RemotePort)
+		forwarders = append(forwarders, f)
+	}
+
+	// reverse forwarders, device listen for them
+	var reversers []*endpointc.Reverser
+	for _, params := range reverses {
+		r := endpointc.NewReverser(params)
+		go r.Serve()
+		reversers = append(reversers, r)
 	}
 
-	// start http server
-	go endpointc.Run(params)
-	log.Println("start lxport endpoint client ok!")
+	var vpns []*endpointc.VPN
+	if vpn {
+		if uuid == "" && pool == "" {
+			log.Fatal("please specify vpn device uuid or pool")
+		}
 
-	if daemon == "yes" {
+		params := &endpointc.VPNParams{
+			UUID:  uuid,
+			Pool:  pool,
+			WsURL: wsURL,
+		}
+		if vpnRoutes != "" {
+			params.Routes = strings.Split(vpnRoutes, ",")
+		}
+
+		v := endpointc.NewVPN(params)
+		go v.Serve()
+		vpns = append(vpns, v)
+	}
+	log.Printf("start lxport endpoint client ok! mappings:%d, reverse mappings:%d, vpn:%v",
+		len(forwarders), len(reversers), vpn)
+
+	infos := listenInfos(forwarders, mappings)
+	err := reportPorts(infos, portFile, printJSON)
+	if err != nil {
+		log.Println("report listen ports failed:", err)
+	}
+
+	exitCode := 0
+	if execCmd != "" {
+		// tear down tunnels when the command exits
+		exitCode, err = launch(execCmd, infos)
+		if err != nil {
+			log.Println("launch command failed:", err)
+			exitCode = 1
+		}
+		log.Println("command exit with code:", exitCode)
+	} else if daemon == "yes" {
 		wait.GetSignal()
 	} else {
 		wait.GetInput()
 	}
+
+	log.Printf("lxport endpoint client draining, at most %s", drain)
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, f := range forwarders {
+		wg.Add(1)
+		go func(f *endpointc.Forwarder) {
+			f.Shutdown(ctx)
+			wg.Done()
+		}(f)
+	}
+	for _, v := range vpns {
+		v.Shutdown(ctx)
+	}
+
+	for _, r := range reversers {
+		wg.Add(1)
+		go func(r *endpointc.Reverser) {
+			r.Shutdown(ctx)
+			wg.Done()
+		}(r)
+	}
+	wg.Wait()
+
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
 	return
 }
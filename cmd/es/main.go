@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -15,13 +19,45 @@ import (
 var (
 	uuid   string
 	wsURL  string
+	pool   string
+	lan    string
+	links  string
+	vpn    bool
+	shell  string
+	execs  string
+	files  string
+	ukey   string
+	udl    time.Duration
+	cfg    string
 	daemon = ""
+	drain  time.Duration
 )
 
 func init() {
 	flag.StringVar(&uuid, "u", "", "specify device uuid")
 	flag.StringVar(&wsURL, "url", "", "specify web ssh path")
+	flag.StringVar(&pool, "pool", "", "specify device pool to join")
+	flag.StringVar(&lan, "lan", "", "specify LAN networks that pair can connect to, eg. 192.168.1.0/24,10.0.0.0/8")
+	flag.StringVar(&links, "link", "", "specify links to other devices lport:device:rport, eg. 5432:hq:5432,8080:@web:80")
+	flag.BoolVar(&vpn, "vpn", false, "specify whether accept vpn pair, packets to -lan networks are forwarded with masquerade, linux only, need iptables and net.ipv4.ip_forward=1")
+	flag.StringVar(&shell, "shell", "", "specify shell that web terminal can open, eg. bash, empty disables it, linux only")
+	flag.StringVar(&execs, "exec", "", "specify commands that server can execute, eg. \"systemctl status,uptime\", empty disables it")
+	flag.StringVar(&files, "files", "", "specify directories that files can be transferred under, eg. /var/log,/tmp, empty disables it")
+	flag.StringVar(&ukey, "ukey", "", "specify base64 ed25519 public key that update must be signed with, empty disables update")
+	flag.DurationVar(&udl, "udl", 60*time.Second, "specify how long updated binary must register in, or roll back")
+	flag.StringVar(&cfg, "cf", defaultConfigPath(), "specify file that config pushed by server persisted to")
 	flag.StringVar(&daemon, "d", "yes", "specify daemon mode")
+	flag.DurationVar(&drain, "drain", 30*time.Second, "specify how long to wait pairs to end when exit")
+}
+
+// defaultConfigPath ~/.lxport/es.json
+func defaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".lxport", "es.json")
 }
 
 // getVersion get version
@@ -55,10 +91,35 @@ func main() {
 	params := &endpoints.Params{
 		UUID:  uuid,
 		WsURL: wsURL,
+		Pool:  pool,
+		VPN:   vpn,
+		Shell: shell,
+
+		Version:        getVersion(),
+		UpdateKey:      ukey,
+		UpdateDeadline: udl,
+
+		ConfigFile: cfg,
+	}
+
+	if lan != "" {
+		params.AllowLAN = strings.Split(lan, ",")
 	}
 
-	// start http server
-	go endpoints.Run(params)
+	if execs != "" {
+		params.ExecAllow = strings.Split(execs, ",")
+	}
+
+	if files != "" {
+		params.FileRoots = strings.Split(files, ",")
+	}
+
+	if links != "" {
+		params.Links = strings.Split(links, ",")
+	}
+
+	agent := endpoints.NewAgent(params)
+	go agent.Run(context.Background())
 	log.Println("start lxport endpoint server ok!")
 
 	if daemon == "yes" {
@@ -66,5 +127,10 @@ func main() {
 	} else {
 		wait.GetInput()
 	}
+
+	log.Printf("lxport endpoint server draining, at most %s", drain)
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	agent.Shutdown(ctx)
 	return
 }
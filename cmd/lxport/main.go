@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"lxport/server"
+	"lxport/upgrade"
 	"lxport/wait"
 )
 
@@ -19,6 +24,28 @@ var (
 	webDir     = ""
 	daemon     = ""
 	pairPath   = ""
+
+	deviceWait    time.Duration
+	dupPolicy     = ""
+	conflictAlert = ""
+	poolStrategy  = ""
+	pairTimeout   time.Duration
+	allowReverse  bool
+	linkRules     = ""
+	vpnSubnet     = ""
+	vpnClients    = ""
+	remoteShell   bool
+	execPath      = ""
+	filePath      = ""
+	proxyPath     = ""
+	proxyDomain   = ""
+	proxyAllow    = ""
+	sniAddr       = ""
+	sniRoutes     = ""
+	updateDir     = ""
+	configDir     = ""
+	drain         time.Duration
+	upgradeWait   time.Duration
 )
 
 func init() {
@@ -28,6 +55,27 @@ func init() {
 	flag.StringVar(&pairPath, "pp", "/pair", "specify web ssh path")
 	flag.StringVar(&webDir, "wd", "", "specify web dir")
 	flag.StringVar(&daemon, "d", "yes", "specify daemon mode")
+	flag.DurationVar(&deviceWait, "dw", 0, "specify how long a pair request waits for an offline device, eg. 20s")
+	flag.StringVar(&dupPolicy, "dup", "replace", "specify duplicate device policy: replace, reject or pool")
+	flag.StringVar(&conflictAlert, "alert", "", "specify command to run when duplicate device registers")
+	flag.StringVar(&poolStrategy, "ps", "rr", "specify device pool strategy: rr, least or rtt")
+	flag.DurationVar(&pairTimeout, "pt", 5*time.Second, "specify how long to wait device to response pair request")
+	flag.BoolVar(&allowReverse, "rev", false, "specify whether endpoint client can ask device to listen for reverse forwarding")
+	flag.StringVar(&linkRules, "link", "", "specify device link rules from:to, eg. branch1:hq,*:@db, * match any device")
+	flag.StringVar(&vpnSubnet, "vpn", "", "specify ipv4 subnet that vpn addresses allocated from, eg. 10.200.0.0/16, empty disables vpn")
+	flag.StringVar(&vpnClients, "vpnallow", "", "specify client networks that allowed to start vpn, eg. 10.0.0.0/8,192.168.1.5")
+	flag.BoolVar(&remoteShell, "rsh", false, "specify whether web ssh can open shell on device, by ?device=uuid")
+	flag.StringVar(&execPath, "ep", "", "specify exec api path, eg. /exec, empty disables it")
+	flag.StringVar(&filePath, "fp", "", "specify file download api path, eg. /file, empty disables it")
+	flag.StringVar(&proxyPath, "proxy", "", "specify path prefix that proxies to device http services, /prefix/<device>/<port>/..., eg. /d/, empty disables it, not allowed with -ep, -fp, -rsh or -wd")
+	flag.StringVar(&proxyDomain, "pdomain", "", "specify domain that its subdomains <device>.domain or <port>.<device>.domain proxy to device http services")
+	flag.StringVar(&proxyAllow, "pallow", "", "specify device:port that proxy allowed to, eg. web1:80,*:8080, * match any, empty refuses all")
+	flag.StringVar(&sniAddr, "sni", "", "specify listen address of raw tls connections that routed to devices by server name, eg. :443")
+	flag.StringVar(&sniRoutes, "sniroute", "", "specify tls server name routes name=device:port, eg. db1.example.com=db1:5432,*.devices.example.com=*:443")
+	flag.StringVar(&updateDir, "update", "", "specify dir of endpoint server builds, with version file, es-<os>-<arch>, its manifest es-<os>-<arch>.manifest and signature of manifest es-<os>-<arch>.sig")
+	flag.StringVar(&configDir, "cfg", "", "specify dir of device config documents, <uuid>.json or default.json")
+	flag.DurationVar(&drain, "drain", 30*time.Second, "specify how long to wait sessions and pairs to end when exit")
+	flag.DurationVar(&upgradeWait, "uw", 30*time.Second, "specify how long to wait new process ready when upgrade by SIGHUP")
 }
 
 // getVersion get version
@@ -60,16 +108,91 @@ func main() {
 		WebPath:    webSSHPath,
 		WebDir:     webDir,
 		PairPath:   pairPath,
+
+		DeviceWaitTimeout: deviceWait,
+		DupPolicy:         dupPolicy,
+		ConflictAlert:     conflictAlert,
+		PoolStrategy:      poolStrategy,
+		PairSetupTimeout:  pairTimeout,
+		AllowReverse:      allowReverse,
+	}
+
+	if linkRules != "" {
+		params.LinkRules = strings.Split(linkRules, ",")
+	}
+
+	params.VPNSubnet = vpnSubnet
+	params.RemoteShell = remoteShell
+	params.ExecPath = execPath
+	params.FilePath = filePath
+	params.ProxyPath = proxyPath
+	params.ProxyDomain = proxyDomain
+	if proxyAllow != "" {
+		params.ProxyAllow = strings.Split(proxyAllow, ",")
+	}
+	params.UpdateDir = updateDir
+	params.ConfigDir = configDir
+	if sniRoutes != "" {
+		params.SNIRoutes = strings.Split(sniRoutes, ",")
+	}
+	if vpnClients != "" {
+		params.VPNClients = strings.Split(vpnClients, ",")
+	}
+
+	// inherit listeners from old process if upgrading
+	l, err := upgrade.Listen("http", "tcp", listenAddr)
+	if err != nil {
+		log.Fatal("lxport server listen failed:", err)
+	}
+
+	var sl net.Listener
+	if sniAddr != "" {
+		sl, err = upgrade.Listen("sni", "tcp", sniAddr)
+		if err != nil {
+			log.Fatal("lxport server sni listen failed:", err)
+		}
 	}
 
 	// start http server
-	go server.CreateHTTPServer(params)
+	srv := server.New(params)
+	go func() {
+		err := srv.Serve(l)
+		if err != nil {
+			log.Fatal("lxport server stopped:", err)
+		}
+	}()
+	if sl != nil {
+		go func() {
+			err := srv.ServeSNI(sl)
+			if err != nil {
+				log.Fatal("lxport server sni stopped:", err)
+			}
+		}()
+	}
 	log.Println("start lxport server ok!")
+	upgrade.Ready()
 
 	if daemon == "yes" {
-		wait.GetSignal()
+		for {
+			s := wait.GetSignal()
+			if !wait.IsUpgrade(s) {
+				break
+			}
+
+			// hand listeners to new process, then drain and exit
+			err = upgrade.Upgrade(upgradeWait)
+			if err == nil {
+				break
+			}
+			log.Println("lxport server upgrade failed:", err)
+		}
 	} else {
 		wait.GetInput()
 	}
+
+	log.Printf("lxport server draining, at most %s", drain)
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	srv.Shutdown(ctx)
 	return
 }
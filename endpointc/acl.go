@@ -0,0 +1,110 @@
+package endpointc
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// unixPrefix prefix of unix socket listen address, eg. unix:/tmp/ec.sock
+const unixPrefix = "unix:"
+
+// splitListenAddress split listen address to network and address
+func splitListenAddress(address string) (string, string) {
+	if strings.HasPrefix(address, unixPrefix) {
+		return "unix", address[len(unixPrefix):]
+	}
+
+	return "tcp", address
+}
+
+// parseCIDRs parse client networks, single ip is treated as host network
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid client network:%s", cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client network:%s", cidr)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// allowClient check client address against allowlist, allow all if
+// allowlist is empty, unix socket client rely on file permission
+func (f *Forwarder) allowClient(addr net.Addr) bool {
+	if len(f.allowNets) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+
+	for _, n := range f.allowNets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkAuth compare user and password with params' auth,
+// always true if no auth is required
+func (f *Forwarder) checkAuth(user string, password string) bool {
+	if f.params.Auth == "" {
+		return true
+	}
+
+	given := []byte(user + ":" + password)
+	return subtle.ConstantTimeCompare(given, []byte(f.params.Auth)) == 1
+}
+
+// checkProxyAuth check Proxy-Authorization header with basic scheme
+func (f *Forwarder) checkProxyAuth(header string) bool {
+	if f.params.Auth == "" {
+		return true
+	}
+
+	const prefix = "Basic "
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return false
+	}
+
+	cred := strings.SplitN(string(decoded), ":", 2)
+	if len(cred) != 2 {
+		return false
+	}
+
+	return f.checkAuth(cred[0], cred[1])
+}
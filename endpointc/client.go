@@ -0,0 +1,137 @@
+package endpointc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"lxport/wsconn"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client endpoint client, create pair stream to device via server
+type Client struct {
+	// base websocket url
+	wsURL string
+
+	dialer *websocket.Dialer
+	header http.Header
+}
+
+// Option client option
+type Option func(*Client)
+
+// WithDialer use custom websocket dialer, eg. with TLS config or proxy
+func WithDialer(dialer *websocket.Dialer) Option {
+	return func(c *Client) {
+		c.dialer = dialer
+	}
+}
+
+// WithHeader add http header to every websocket handshake
+func WithHeader(header http.Header) Option {
+	return func(c *Client) {
+		c.header = header
+	}
+}
+
+// NewClient create client with server's base websocket url
+func NewClient(wsURL string, opts ...Option) *Client {
+	c := &Client{
+		wsURL:  wsURL,
+		dialer: websocket.DefaultDialer,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Target pair target
+type Target struct {
+	// device uuid
+	Device string
+	// device pool, take precedence over Device
+	Pool string
+	// optional, host in device's network, device must allow it
+	Host string
+	// port that device connect to
+	Port uint16
+	// udp datagrams instead of tcp stream, framed with association id
+	UDP bool
+}
+
+// String readable target
+func (t *Target) String() string {
+	name := t.Device
+	if t.Pool != "" {
+		name = "pool:" + t.Pool
+	}
+
+	host := t.Host
+	if host == "" {
+		host = "localhost"
+	}
+
+	return fmt.Sprintf("%s/%s:%d", name, host, t.Port)
+}
+
+// Dial create a pair stream to port of device, return after
+// the device has connected to the port
+func (c *Client) Dial(ctx context.Context, device string, port uint16) (net.Conn, error) {
+	return c.DialTarget(ctx, &Target{Device: device, Port: port})
+}
+
+// DialPool create a pair stream to port of a device in pool
+func (c *Client) DialPool(ctx context.Context, pool string, port uint16) (net.Conn, error) {
+	return c.DialTarget(ctx, &Target{Pool: pool, Port: port})
+}
+
+// DialTarget create a pair stream to target
+func (c *Client) DialTarget(ctx context.Context, target *Target) (net.Conn, error) {
+	query := url.Values{}
+	if target.Pool != "" {
+		query.Set("pool", target.Pool)
+	} else {
+		query.Set("uuid", target.Device)
+	}
+
+	if target.Host != "" {
+		query.Set("host", target.Host)
+	}
+
+	if target.UDP {
+		query.Set("kind", "udp")
+	}
+
+	return c.dial(ctx, query, target.Port)
+}
+
+func (c *Client) dial(ctx context.Context, query url.Values, port uint16) (net.Conn, error) {
+	query.Set("pt", "req")
+	query.Set("port", strconv.Itoa(int(port)))
+	// ask server to notify when pair established
+	query.Set("ready", "1")
+
+	ws, _, err := c.dialer.DialContext(ctx, c.wsURL+"?"+query.Encode(), c.header)
+	if err != nil {
+		return nil, err
+	}
+
+	// wait pair established, or server close the websocket
+	err = wsconn.WaitReady(ctx, ws)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("pair to port %d failed: %v", port, err)
+	}
+
+	return wsconn.New(ws), nil
+}
@@ -1,28 +1,13 @@
 package endpointc
 
 import (
-	"fmt"
-
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	// local listen tcp port
-	localPort uint16 //  = 8009
-	// remote port, that endpoint server
-	// should connect to
-	remotePort uint16 // = 3389
-	// device uuid
-	deviceID string
-	// base websocket url
-	wsURL string
-
-	// compressed   int64
-	// decompressed int64
-)
-
 // Params parameters
 type Params struct {
+	// optional, name of the mapping, for logs
+	Name string
 	// local listen tcp port
 	LocalPort uint16
 	// remote port, that endpoint server
@@ -32,16 +17,39 @@ type Params struct {
 	UUID string
 	// base websocket url
 	WsURL string
+	// optional, target device pool, take precedence over UUID
+	Pool string
+	// optional, socks5 listen address, if provided, act as socks5
+	// proxy to device's network instead of forwarding LocalPort
+	Socks string
+	// optional, http proxy listen address, if provided, act as http
+	// proxy to device's network instead of forwarding LocalPort
+	HTTPProxy string
+
+	// optional, bind address of LocalPort, default is 127.0.0.1,
+	// ipv6 address or unix:/path/to/socket are also supported
+	Bind string
+	// optional, client networks(CIDR) that allowed to connect,
+	// allow all if empty
+	AllowClients []string
+	// optional, user:password that socks5/http proxy client must provide,
+	// not allowed for port forwarding, use AllowClients instead
+	Auth string
+	// optional, max concurrent forwarded connections, 0 means unlimited
+	MaxConns int
+	// optional, forward udp datagrams of LocalPort instead of tcp
+	UDP bool
 }
 
 // Run run endpoint client and
 // wait client to connect
 func Run(params *Params) {
-	localPort = params.LocalPort
-	remotePort = params.RemotePort
-	deviceID = params.UUID
-	wsURL = fmt.Sprintf("%s?pt=req&uuid=%s&port=%d", params.WsURL, deviceID, remotePort)
+	f, err := Listen(params)
+	if err != nil {
+		log.Fatal("endpoint tcp server listen failed:", err)
+	}
 
-	log.Printf("endpoint run, local port:%d, target port:%d, device uuid:%s", localPort, remotePort, deviceID)
-	startTCPListener(localPort)
+	log.Printf("endpoint run, local port:%d, target port:%d, device uuid:%s, pool:%s",
+		params.LocalPort, params.RemotePort, params.UUID, params.Pool)
+	f.Serve()
 }
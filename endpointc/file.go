@@ -0,0 +1,300 @@
+package endpointc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"lxport/wsconn"
+)
+
+// size of data message of file transfer
+const fileChunkSize = 32 * 1024
+
+// suffix of partial file that get writes to
+const filePartSuffix = ".part"
+
+// FileInfo entry of device's directory
+type FileInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// os.FileMode bits
+	Mode uint32 `json:"mode"`
+	// unix seconds
+	ModTime int64 `json:"modTime"`
+	Dir     bool  `json:"dir,omitempty"`
+}
+
+// fileRequest the first message of file pair
+type fileRequest struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Offset int64  `json:"offset,omitempty"`
+	Sum    bool   `json:"sum,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// fileResponse response of device, data messages follow that of get
+// and put, an empty message marks the end
+type fileResponse struct {
+	Error   string      `json:"error,omitempty"`
+	Size    int64       `json:"size"`
+	Offset  int64       `json:"offset,omitempty"`
+	SHA256  string      `json:"sha256,omitempty"`
+	Entries []*FileInfo `json:"entries,omitempty"`
+}
+
+// dialFile create file pair to device, send request and read response
+func (c *Client) dialFile(ctx context.Context, device string, req *fileRequest) (*wsconn.Conn, *fileResponse, error) {
+	query := url.Values{}
+	query.Set("uuid", device)
+	query.Set("kind", "file")
+
+	conn, err := c.dial(ctx, query, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream := conn.(*wsconn.Conn)
+
+	b, _ := json.Marshal(req)
+	_, err = stream.Write(b)
+	if err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+
+	resp, err := readFileResponse(stream)
+	if err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+
+	return stream, resp, nil
+}
+
+// readFileResponse read json response, error reported by device is returned as error
+func readFileResponse(stream *wsconn.Conn) (*fileResponse, error) {
+	message, err := stream.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &fileResponse{}
+	err = json.Unmarshal(message, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+
+	return resp, nil
+}
+
+// ListFiles list directory of device
+func (c *Client) ListFiles(ctx context.Context, device string, path string) ([]*FileInfo, error) {
+	stream, resp, err := c.dialFile(ctx, device, &fileRequest{Op: "list", Path: path})
+	if err != nil {
+		return nil, err
+	}
+	stream.Close()
+
+	return resp.Entries, nil
+}
+
+// SumFile size and hex sha256 of file of device
+func (c *Client) SumFile(ctx context.Context, device string, path string) (int64, string, error) {
+	stream, resp, err := c.dialFile(ctx, device, &fileRequest{Op: "sum", Path: path})
+	if err != nil {
+		return 0, "", err
+	}
+	stream.Close()
+
+	return resp.Size, resp.SHA256, nil
+}
+
+// GetFile download file of device to local path. Data is written to
+// local path + ".part" first, and a later call resumes from it; the
+// part is renamed to local path after sha256 verified
+func (c *Client) GetFile(ctx context.Context, device string, remote string, local string) error {
+	part := local + filePartSuffix
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req := &fileRequest{Op: "get", Path: remote, Offset: offset, Sum: true}
+	stream, resp, err := c.dialFile(ctx, device, req)
+	if err != nil {
+		if offset == 0 {
+			// nothing received, do not leave empty part
+			f.Close()
+			os.Remove(part)
+		}
+		return err
+	}
+	defer stream.Close()
+
+	if resp.Offset != offset {
+		// device start over, part is not of the file
+		offset = resp.Offset
+		if err := f.Truncate(offset); err != nil {
+			return err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	// close stream if canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		message, err := stream.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("interrupted at %d of %d, run again to resume: %v", offset, resp.Size, err)
+		}
+
+		if len(message) == 0 {
+			break
+		}
+
+		_, err = f.Write(message)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(message))
+	}
+
+	sum, err := sumReader(io.NewSectionReader(f, 0, offset))
+	if err != nil {
+		return err
+	}
+
+	if offset != resp.Size || sum != resp.SHA256 {
+		f.Close()
+		os.Remove(part)
+		return errors.New("sha256 mismatch, file may changed, run again")
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(part, local)
+}
+
+// PutFile upload local file to path of device. Device keeps partial file
+// if interrupted, and a later call resumes from it
+func (c *Client) PutFile(ctx context.Context, device string, local string, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := st.Size()
+	sum, err := sumReader(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return err
+	}
+
+	req := &fileRequest{Op: "put", Path: remote, Size: size, SHA256: sum}
+	stream, resp, err := c.dialFile(ctx, device, req)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// close stream if canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Close()
+		case <-done:
+		}
+	}()
+
+	b := make([]byte, fileChunkSize)
+	r := io.NewSectionReader(f, resp.Offset, size-resp.Offset)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if _, err := stream.Write(b[:n]); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("interrupted, run again to resume: %v", err)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// end of data
+	_, err = stream.Write([]byte{})
+	if err != nil {
+		return err
+	}
+
+	resp, err = readFileResponse(stream)
+	if err != nil {
+		return err
+	}
+
+	if resp.SHA256 != sum {
+		return errors.New("sha256 mismatch")
+	}
+
+	return nil
+}
+
+// sumReader hex sha256 of all data of r
+func sumReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
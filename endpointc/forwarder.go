@@ -0,0 +1,280 @@
+package endpointc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lxport/wsconn"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Forwarder accept tcp connection from local listener,
+// and forward it to device's port via pair stream
+type Forwarder struct {
+	client *Client
+	params *Params
+	// logger with mapping name
+	log *log.Entry
+
+	listener net.Listener
+	// udp socket, instead of listener if params.UDP
+	packetConn net.PacketConn
+	// client networks that allowed to connect
+	allowNets []*net.IPNet
+
+	// protect conns and closing
+	lock sync.Mutex
+	// current forwarded connections
+	conns   map[net.Conn]struct{}
+	closing bool
+
+	// udp pair stream, shared by all associations
+	udpStream *wsconn.Conn
+	// udp association id index by source address
+	udpIDs map[string]uint32
+	// udp association index by id
+	udpPeers map[uint32]*udpPeer
+	udpSeq   uint32
+}
+
+// Listen create forwarder, listen on bind address(localhost by default),
+// or on socks5/http proxy address if it is provided
+func Listen(params *Params) (*Forwarder, error) {
+	allowNets, err := parseCIDRs(params.AllowClients)
+	if err != nil {
+		return nil, err
+	}
+
+	// raw forwarded connection has no way to carry credentials
+	if params.Auth != "" && params.Socks == "" && params.HTTPProxy == "" {
+		return nil, errors.New("auth only apply to socks5 and http proxy mode, port forwarding rely on client allowlist")
+	}
+
+	bind := params.Bind
+	if bind == "" {
+		bind = "127.0.0.1"
+	}
+
+	address := net.JoinHostPort(bind, strconv.Itoa(int(params.LocalPort)))
+	if strings.HasPrefix(bind, unixPrefix) {
+		address = bind
+	}
+
+	if params.Socks != "" {
+		address = params.Socks
+	} else if params.HTTPProxy != "" {
+		address = params.HTTPProxy
+	}
+
+	f := &Forwarder{
+		client:    NewClient(params.WsURL),
+		params:    params,
+		allowNets: allowNets,
+		conns:     make(map[net.Conn]struct{}),
+		udpIDs:    make(map[string]uint32),
+		udpPeers:  make(map[uint32]*udpPeer),
+	}
+
+	network, address := splitListenAddress(address)
+	if params.UDP {
+		if network != "tcp" {
+			return nil, fmt.Errorf("udp mapping can not listen on %s", address)
+		}
+
+		f.packetConn, err = net.ListenPacket("udp", address)
+	} else {
+		f.listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	name := params.Name
+	if name == "" {
+		name = f.Addr().String()
+	}
+	f.log = log.WithField("mapping", name)
+
+	return f, nil
+}
+
+// Addr listen address
+func (f *Forwarder) Addr() net.Addr {
+	if f.packetConn != nil {
+		return f.packetConn.LocalAddr()
+	}
+
+	return f.listener.Addr()
+}
+
+// Serve accept connections until Shutdown
+func (f *Forwarder) Serve() error {
+	if f.packetConn != nil {
+		return f.serveUDP()
+	}
+
+	for {
+		// Listen for an incoming connection.
+		conn, err := f.listener.Accept()
+		if err != nil {
+			if f.isClosing() {
+				return nil
+			}
+
+			f.log.Println("Forwarder error accepting: ", err.Error())
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if !f.allowClient(conn.RemoteAddr()) {
+			f.log.Warnf("reject client %s, not in allowlist", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		if !f.track(conn) {
+			conn.Close()
+			continue
+		}
+
+		// Handle connections in a new goroutine.
+		go f.handleRequest(conn)
+	}
+}
+
+// Shutdown stop accepting connections, and wait existing ones to end.
+// When ctx is done, all remaining connections are closed
+func (f *Forwarder) Shutdown(ctx context.Context) error {
+	f.lock.Lock()
+	f.closing = true
+	udpStream := f.udpStream
+	f.lock.Unlock()
+
+	if f.packetConn != nil {
+		f.packetConn.Close()
+		if udpStream != nil {
+			udpStream.Close()
+		}
+		return nil
+	}
+
+	f.listener.Close()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for n := f.activeConns(); n > 0; n = f.activeConns() {
+		select {
+		case <-ctx.Done():
+			f.log.Warnf("Forwarder drain deadline, close %d connections", n)
+			f.lock.Lock()
+			for conn := range f.conns {
+				conn.Close()
+			}
+			f.lock.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// isClosing return true if Shutdown has been called
+func (f *Forwarder) isClosing() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.closing
+}
+
+// track save connection, return false if shutting down
+// or too many connections
+func (f *Forwarder) track(conn net.Conn) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closing {
+		return false
+	}
+
+	if f.params.MaxConns > 0 && len(f.conns) >= f.params.MaxConns {
+		f.log.Warnf("reject client %s, too many connections:%d", conn.RemoteAddr(), len(f.conns))
+		return false
+	}
+
+	f.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack remove connection
+func (f *Forwarder) untrack(conn net.Conn) {
+	f.lock.Lock()
+	delete(f.conns, conn)
+	f.lock.Unlock()
+}
+
+// activeConns current forwarded connection count
+func (f *Forwarder) activeConns() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.conns)
+}
+
+// target pair target of params
+func (f *Forwarder) target() *Target {
+	return paramsTarget(f.params)
+}
+
+// paramsTarget pair target of params
+func paramsTarget(params *Params) *Target {
+	return &Target{
+		Device: params.UUID,
+		Pool:   params.Pool,
+		Port:   params.RemotePort,
+		UDP:    params.UDP,
+	}
+}
+
+// handleRequest create pair stream for tcp connection, and bridge them
+func (f *Forwarder) handleRequest(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		f.untrack(conn)
+	}()
+
+	if f.params.Socks != "" {
+		f.handleSocks(conn)
+		return
+	}
+
+	if f.params.HTTPProxy != "" {
+		f.handleHTTPProxy(conn)
+		return
+	}
+
+	target := f.target()
+	stream, err := f.client.DialTarget(context.Background(), target)
+	if err != nil {
+		f.log.Printf("handleRequest failed create pair to %s: %v", target, err)
+		return
+	}
+
+	// ensure pair stream will be closed final
+	defer stream.Close()
+
+	f.log.Printf("connection from %s to %s opened, active:%d", conn.RemoteAddr(), target, f.activeConns())
+	wsconn.Bridge(conn, stream)
+	f.log.Printf("connection from %s to %s closed, active:%d", conn.RemoteAddr(), target, f.activeConns()-1)
+}
@@ -0,0 +1,231 @@
+package endpointc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"lxport/wsconn"
+)
+
+// suffix of host name that encode device and port, eg. 3389.device-uuid.lxport
+const deviceHostSuffix = ".lxport"
+
+// hop-by-hop headers that should not be forwarded
+var hopHeaders = []string{
+	"Proxy-Connection",
+	"Proxy-Authorization",
+	"Proxy-Authenticate",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+}
+
+// bufConn connection that read from buffered reader first
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// handleHTTPProxy serve http proxy requests of connection, CONNECT request
+// is bridged to pair stream, other requests are forwarded one by one
+func (f *Forwarder) handleHTTPProxy(conn net.Conn) {
+	br := bufio.NewReader(conn)
+
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				f.log.Println("handleHTTPProxy read request failed:", err)
+			}
+			return
+		}
+
+		if !f.checkProxyAuth(req.Header.Get("Proxy-Authorization")) {
+			f.log.Warnf("handleHTTPProxy auth failed, client:%s", conn.RemoteAddr())
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: Basic realm=\"lxport\"\r\nContent-Length: 0\r\n\r\n")
+			io.Copy(ioutil.Discard, req.Body)
+			if req.Close {
+				return
+			}
+			continue
+		}
+
+		if req.Method == http.MethodConnect {
+			f.handleConnect(&bufConn{Conn: conn, r: br}, req)
+			return
+		}
+
+		if !f.forwardHTTP(&bufConn{Conn: conn, r: br}, req) {
+			return
+		}
+	}
+}
+
+// handleConnect create pair stream to CONNECT target, and bridge them
+func (f *Forwarder) handleConnect(conn net.Conn, req *http.Request) {
+	target, err := f.resolveTarget(req.Host, 0)
+	if err != nil {
+		httpProxyError(conn, http.StatusBadRequest, err)
+		return
+	}
+
+	stream, err := f.client.DialTarget(context.Background(), target)
+	if err != nil {
+		f.log.Printf("handleConnect failed create pair to %s: %v", target, err)
+		httpProxyError(conn, http.StatusBadGateway, err)
+		return
+	}
+
+	// ensure pair stream will be closed final
+	defer stream.Close()
+
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	if err != nil {
+		return
+	}
+
+	f.log.Printf("handleConnect pair to %s", target)
+	wsconn.Bridge(conn, stream)
+}
+
+// forwardHTTP forward plain http request via a new pair stream,
+// return false if client connection should be closed
+func (f *Forwarder) forwardHTTP(conn net.Conn, req *http.Request) bool {
+	if req.URL.Host == "" {
+		httpProxyError(conn, http.StatusBadRequest, fmt.Errorf("need absolute url"))
+		return false
+	}
+
+	target, err := f.resolveTarget(req.URL.Host, 80)
+	if err != nil {
+		httpProxyError(conn, http.StatusBadRequest, err)
+		return false
+	}
+
+	stream, err := f.client.DialTarget(context.Background(), target)
+	if err != nil {
+		f.log.Printf("forwardHTTP failed create pair to %s: %v", target, err)
+		httpProxyError(conn, http.StatusBadGateway, err)
+		return !req.Close
+	}
+
+	// ensure pair stream will be closed final
+	defer stream.Close()
+
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+
+	// one request per pair stream
+	clientClose := req.Close
+	req.Close = true
+	err = req.Write(stream)
+	if err != nil {
+		f.log.Println("forwardHTTP write request failed:", err)
+		return false
+	}
+
+	sr := bufio.NewReader(stream)
+	resp, err := http.ReadResponse(sr, req)
+	if err != nil {
+		f.log.Println("forwardHTTP read response failed:", err)
+		httpProxyError(conn, http.StatusBadGateway, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// eg. websocket, bridge the raw streams after response header
+		resp.Write(conn)
+		wsconn.Bridge(conn, &bufConn{Conn: stream, r: sr})
+		return false
+	}
+
+	// keep client connection alive unless client ask to close, or body
+	// of response ends with the connection
+	resp.Close = clientClose || eofDelimited(req, resp)
+	err = resp.Write(conn)
+	if err != nil {
+		return false
+	}
+
+	return !resp.Close
+}
+
+// eofDelimited check if response has body without length or chunked
+// encoding, that only closing connection can end
+func eofDelimited(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead || resp.StatusCode < 200 ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+
+	return resp.ContentLength < 0 && len(resp.TransferEncoding) == 0
+}
+
+// httpProxyError write error response
+func httpProxyError(conn net.Conn, code int, err error) {
+	body := err.Error() + "\n"
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s",
+		code, http.StatusText(code), len(body), body)
+}
+
+// resolveTarget resolve proxy address to pair target, address in form of
+// port.device-uuid.lxport or device-uuid.lxport:port target the device,
+// otherwise target the host in network of params' device
+func (f *Forwarder) resolveTarget(address string, defaultPort uint16) (*Target, error) {
+	host := address
+	port := defaultPort
+
+	h, p, err := net.SplitHostPort(address)
+	if err == nil {
+		host = h
+		pn, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port:%s", p)
+		}
+		port = uint16(pn)
+	}
+
+	if strings.HasSuffix(strings.ToLower(host), deviceHostSuffix) {
+		name := host[:len(host)-len(deviceHostSuffix)]
+		labels := strings.SplitN(name, ".", 2)
+		if len(labels) == 2 {
+			pn, err := strconv.ParseUint(labels[0], 10, 16)
+			if err == nil {
+				port = uint16(pn)
+				name = labels[1]
+			}
+		}
+
+		if name == "" || port == 0 {
+			return nil, fmt.Errorf("invalid device address:%s", address)
+		}
+
+		return &Target{Device: name, Port: port}, nil
+	}
+
+	if port == 0 {
+		return nil, fmt.Errorf("need port:%s", address)
+	}
+
+	target := f.target()
+	target.Port = port
+	if !isLocalHost(host) {
+		target.Host = host
+	}
+
+	return target, nil
+}
@@ -0,0 +1,154 @@
+package endpointc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Profile named group of port mappings
+type Profile struct {
+	// optional, base websocket url, override the file's url
+	URL string `yaml:"url"`
+	// mappings in form of lport:device:rport
+	Mappings []string `yaml:"mappings"`
+}
+
+// ProfileFile profile file content in yaml, json is accepted too, eg.
+//
+//	url: wss://relay/pair
+//	profiles:
+//	  office:
+//	    mappings: ["13389:pc-1:3389", "2222:@web:22"]
+type ProfileFile struct {
+	// base websocket url
+	URL string `yaml:"url"`
+	// profiles index by name
+	Profiles map[string]*Profile `yaml:"profiles"`
+}
+
+// DefaultProfilePath profile file path under user's home, ~/.lxport/ec.yaml,
+// or ~/.lxport/ec.json if only it exists
+func DefaultProfilePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	path := filepath.Join(home, ".lxport", "ec.yaml")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		jsonPath := filepath.Join(home, ".lxport", "ec.json")
+		if _, err := os.Stat(jsonPath); err == nil {
+			return jsonPath
+		}
+	}
+
+	return path
+}
+
+// LoadProfile load mappings of profile with name from profile file,
+// the base websocket url of mappings is filled
+func LoadProfile(path string, name string) ([]*Params, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pf := &ProfileFile{}
+	err = yaml.Unmarshal(content, pf)
+	if err != nil {
+		return nil, fmt.Errorf("parse profile file %s failed: %v", path, err)
+	}
+
+	profile, ok := pf.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile %s in %s", name, path)
+	}
+
+	url := profile.URL
+	if url == "" {
+		url = pf.URL
+	}
+
+	var mappings []*Params
+	for _, m := range profile.Mappings {
+		params, err := ParseMapping(m)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+
+		params.WsURL = url
+		params.Name = name + "/" + params.Name
+		mappings = append(mappings, params)
+	}
+
+	return mappings, nil
+}
+
+// ParseMapping parse mapping in form of [bind:]lport:device:rport or
+// unix:/path/to/socket:device:rport, device with prefix @ means device pool,
+// rport with suffix /udp means udp mapping,
+// eg. 8009:@web:80, [::1]:2222:pc-1:22, 5353:pc-1:53/udp
+func ParseMapping(s string) (*Params, error) {
+	// parse from right, bind address may contain colon
+	i := strings.LastIndex(s, ":")
+	j := -1
+	if i > 0 {
+		j = strings.LastIndex(s[:i], ":")
+	}
+
+	if j < 0 {
+		return nil, fmt.Errorf("invalid mapping %s, need [bind:]lport:device:rport", s)
+	}
+
+	// remote port with "/udp" suffix means udp mapping
+	remote := s[i+1:]
+	udp := strings.HasSuffix(remote, "/udp")
+	remote = strings.TrimSuffix(remote, "/udp")
+
+	rport, err := strconv.ParseUint(remote, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote port of mapping %s", s)
+	}
+
+	device := s[j+1 : i]
+	if device == "" || device == "@" {
+		return nil, fmt.Errorf("invalid device of mapping %s", s)
+	}
+
+	params := &Params{
+		Name:       s,
+		RemotePort: uint16(rport),
+		UDP:        udp,
+	}
+
+	local := s[:j]
+	if strings.HasPrefix(local, unixPrefix) {
+		params.Bind = local
+	} else {
+		k := strings.LastIndex(local, ":")
+		if k >= 0 {
+			params.Bind = strings.Trim(local[:k], "[]")
+			local = local[k+1:]
+		}
+
+		lport, err := strconv.ParseUint(local, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local port of mapping %s", s)
+		}
+		params.LocalPort = uint16(lport)
+	}
+
+	if strings.HasPrefix(device, "@") {
+		params.Pool = device[1:]
+	} else {
+		params.UUID = device
+	}
+
+	return params, nil
+}
@@ -0,0 +1,281 @@
+package endpointc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lxport/wsconn"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// command from server to reverse forwarder, same as device command
+const cmdPairCreate = 0
+
+// ReverseParams parameters of reverse forwarding, device listen
+// on RemotePort, connections are forwarded to LocalHost:LocalPort
+type ReverseParams struct {
+	// optional, name of the mapping, for logs
+	Name string
+	// device uuid
+	UUID string
+	// base websocket url
+	WsURL string
+	// port that device listen on, localhost of device only
+	RemotePort uint16
+	// optional, host that endpoint client connect to, default is localhost
+	LocalHost string
+	// port that endpoint client connect to
+	LocalPort uint16
+}
+
+// ParseReverse parse reverse mapping "rport:lport" or "rport:lhost:lport"
+func ParseReverse(s string) (*ReverseParams, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("invalid reverse mapping %q, expect rport:[lhost:]lport", s)
+	}
+
+	rport, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reverse mapping %q, bad remote port: %v", s, err)
+	}
+
+	lport, err := strconv.ParseUint(parts[len(parts)-1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reverse mapping %q, bad local port: %v", s, err)
+	}
+
+	params := &ReverseParams{
+		Name:       s,
+		RemotePort: uint16(rport),
+		LocalPort:  uint16(lport),
+	}
+
+	if len(parts) == 3 {
+		params.LocalHost = parts[1]
+	}
+
+	return params, nil
+}
+
+// Reverser ask device to listen on port, and forward connections
+// accepted by device to local host:port, like ssh -R
+type Reverser struct {
+	client *Client
+	params *ReverseParams
+	// logger with mapping name
+	log *log.Entry
+
+	// protect ws, conns and closing
+	lock sync.Mutex
+	// current control websocket
+	ws *websocket.Conn
+	// current forwarded connections
+	conns   map[net.Conn]struct{}
+	closing bool
+}
+
+// NewReverser create reverse forwarder
+func NewReverser(params *ReverseParams) *Reverser {
+	name := params.Name
+	if name == "" {
+		name = fmt.Sprintf("R%d", params.RemotePort)
+	}
+
+	return &Reverser{
+		client: NewClient(params.WsURL),
+		params: params,
+		log:    log.WithField("mapping", name),
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve keep device listening until Shutdown,
+// re-request when server or device reconnects
+func (r *Reverser) Serve() error {
+	for !r.isClosing() {
+		err := r.serveOnce()
+		if r.isClosing() {
+			break
+		}
+
+		r.log.Println("Reverser control websocket closed, retry later:", err)
+		time.Sleep(5 * time.Second)
+	}
+
+	return nil
+}
+
+// serveOnce request device to listen, and serve pair create
+// request until control websocket closed
+func (r *Reverser) serveOnce() error {
+	query := url.Values{}
+	query.Set("pt", "rev")
+	query.Set("uuid", r.params.UUID)
+	query.Set("port", strconv.Itoa(int(r.params.RemotePort)))
+
+	c := r.client
+	ws, _, err := c.dialer.Dial(c.wsURL+"?"+query.Encode(), c.header)
+	if err != nil {
+		return err
+	}
+
+	defer ws.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	err = wsconn.WaitReady(ctx, ws)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	if !r.setWS(ws) {
+		return nil
+	}
+	defer r.setWS(nil)
+
+	r.log.Printf("Reverser device %s listen on port %d", r.params.UUID, r.params.RemotePort)
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		if len(message) < 4 || message[0] != cmdPairCreate {
+			r.log.Errorf("Reverser unsupport message, length:%d", len(message))
+			continue
+		}
+
+		uuid := string(message[3:])
+		go r.handlePair(uuid)
+	}
+}
+
+// handlePair connect to local port, and response the pair
+func (r *Reverser) handlePair(uuid string) {
+	host := r.params.LocalHost
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(r.params.LocalPort)))
+
+	// connect before response, server close the pair if not response
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		r.log.Errorf("Reverser connect to %s failed:%v", address, err)
+		return
+	}
+
+	defer conn.Close()
+
+	if !r.track(conn) {
+		return
+	}
+	defer r.untrack(conn)
+
+	c := r.client
+	wsURLResp := fmt.Sprintf("%s?pt=resp&uuid=%s", c.wsURL, uuid)
+	ws, _, err := c.dialer.Dial(wsURLResp, c.header)
+	if err != nil {
+		r.log.Println("Reverser failed connect to websocket server:", err)
+		return
+	}
+
+	stream := wsconn.New(ws)
+	defer stream.Close()
+
+	r.log.Printf("connection to %s opened, active:%d", address, r.activeConns())
+	wsconn.Bridge(conn, stream)
+	r.log.Printf("connection to %s closed, active:%d", address, r.activeConns()-1)
+}
+
+// Shutdown ask device to close listener, and wait existing
+// connections to end. When ctx is done, all remaining connections are closed
+func (r *Reverser) Shutdown(ctx context.Context) error {
+	r.lock.Lock()
+	r.closing = true
+	ws := r.ws
+	r.lock.Unlock()
+
+	// server ask device to close listener when control websocket closed
+	if ws != nil {
+		ws.Close()
+	}
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for n := r.activeConns(); n > 0; n = r.activeConns() {
+		select {
+		case <-ctx.Done():
+			r.log.Warnf("Reverser drain deadline, close %d connections", n)
+			r.lock.Lock()
+			for conn := range r.conns {
+				conn.Close()
+			}
+			r.lock.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// setWS save current control websocket, return false if shutting down
+func (r *Reverser) setWS(ws *websocket.Conn) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closing {
+		return false
+	}
+
+	r.ws = ws
+	return true
+}
+
+// isClosing return true if Shutdown has been called
+func (r *Reverser) isClosing() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.closing
+}
+
+// track save connection, return false if shutting down
+func (r *Reverser) track(conn net.Conn) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closing {
+		return false
+	}
+
+	r.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack remove connection
+func (r *Reverser) untrack(conn net.Conn) {
+	r.lock.Lock()
+	delete(r.conns, conn)
+	r.lock.Unlock()
+}
+
+// activeConns current forwarded connection count
+func (r *Reverser) activeConns() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return len(r.conns)
+}
@@ -0,0 +1,227 @@
+package endpointc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"lxport/wsconn"
+)
+
+// socks5 protocol constants, see RFC 1928
+const (
+	socksVersion = 5
+
+	socksMethodNoAuth       = 0
+	socksMethodUserPass     = 2
+	socksMethodNoAcceptable = 0xff
+
+	// username/password auth, see RFC 1929
+	socksUserPassVersion = 1
+	socksUserPassSuccess = 0
+	socksUserPassFailure = 1
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSucceeded        = 0
+	socksRepGeneralFailure   = 1
+	socksRepHostUnreachable  = 4
+	socksRepCmdNotSupported  = 7
+	socksRepAtypNotSupported = 8
+)
+
+// handleSocks serve socks5 CONNECT request, create pair stream to
+// the requested host:port in device's network, and bridge them
+func (f *Forwarder) handleSocks(conn net.Conn) {
+	err := f.socksHandshake(conn)
+	if err != nil {
+		f.log.Println("handleSocks handshake failed:", err)
+		return
+	}
+
+	host, port, rep := socksReadRequest(conn)
+	if rep != socksRepSucceeded {
+		socksReply(conn, rep)
+		return
+	}
+
+	target, err := f.resolveTarget(net.JoinHostPort(host, strconv.Itoa(int(port))), 0)
+	if err != nil {
+		f.log.Println("handleSocks invalid target:", err)
+		socksReply(conn, socksRepHostUnreachable)
+		return
+	}
+
+	stream, err := f.client.DialTarget(context.Background(), target)
+	if err != nil {
+		f.log.Printf("handleSocks failed create pair to %s: %v", target, err)
+		socksReply(conn, socksRepHostUnreachable)
+		return
+	}
+
+	// ensure pair stream will be closed final
+	defer stream.Close()
+
+	err = socksReply(conn, socksRepSucceeded)
+	if err != nil {
+		return
+	}
+
+	f.log.Printf("handleSocks pair to %s", target)
+	wsconn.Bridge(conn, stream)
+}
+
+// socksHandshake read client greeting, require username/password
+// method if auth is configured, otherwise no-auth method
+func (f *Forwarder) socksHandshake(conn net.Conn) error {
+	// version + method count
+	head := make([]byte, 2)
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return err
+	}
+
+	if head[0] != socksVersion {
+		return fmt.Errorf("unsupport socks version:%d", head[0])
+	}
+
+	methods := make([]byte, head[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return err
+	}
+
+	want := byte(socksMethodNoAuth)
+	if f.params.Auth != "" {
+		want = socksMethodUserPass
+	}
+
+	for _, m := range methods {
+		if m != want {
+			continue
+		}
+
+		_, err = conn.Write([]byte{socksVersion, want})
+		if err != nil || want == socksMethodNoAuth {
+			return err
+		}
+
+		return f.socksUserPass(conn)
+	}
+
+	conn.Write([]byte{socksVersion, socksMethodNoAcceptable})
+	return fmt.Errorf("no acceptable auth method")
+}
+
+// socksUserPass read username/password sub-negotiation and check it
+func (f *Forwarder) socksUserPass(conn net.Conn) error {
+	// version + username length
+	head := make([]byte, 2)
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return err
+	}
+
+	if head[0] != socksUserPassVersion {
+		return fmt.Errorf("unsupport username/password version:%d", head[0])
+	}
+
+	user := make([]byte, head[1])
+	_, err = io.ReadFull(conn, user)
+	if err != nil {
+		return err
+	}
+
+	l := make([]byte, 1)
+	_, err = io.ReadFull(conn, l)
+	if err != nil {
+		return err
+	}
+
+	password := make([]byte, l[0])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return err
+	}
+
+	if !f.checkAuth(string(user), string(password)) {
+		conn.Write([]byte{socksUserPassVersion, socksUserPassFailure})
+		return fmt.Errorf("auth failed, user:%s", user)
+	}
+
+	_, err = conn.Write([]byte{socksUserPassVersion, socksUserPassSuccess})
+	return err
+}
+
+// socksReadRequest read CONNECT request, return target host and port,
+// rep is not socksRepSucceeded if request is not supported
+func socksReadRequest(conn net.Conn) (string, uint16, byte) {
+	// version + command + reserved + address type
+	head := make([]byte, 4)
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return "", 0, socksRepGeneralFailure
+	}
+
+	if head[1] != socksCmdConnect {
+		return "", 0, socksRepCmdNotSupported
+	}
+
+	var host string
+	switch head[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if head[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+
+		ip := make([]byte, size)
+		_, err = io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		l := make([]byte, 1)
+		_, err = io.ReadFull(conn, l)
+		if err == nil {
+			domain := make([]byte, l[0])
+			_, err = io.ReadFull(conn, domain)
+			host = string(domain)
+		}
+	default:
+		return "", 0, socksRepAtypNotSupported
+	}
+
+	if err != nil {
+		return "", 0, socksRepGeneralFailure
+	}
+
+	pb := make([]byte, 2)
+	_, err = io.ReadFull(conn, pb)
+	if err != nil {
+		return "", 0, socksRepGeneralFailure
+	}
+
+	return host, binary.BigEndian.Uint16(pb), socksRepSucceeded
+}
+
+// socksReply write reply with zero bound address
+func socksReply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socksVersion, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// isLocalHost return true if host means device itself
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,25 @@
+package endpointc
+
+import (
+	"context"
+	"io"
+)
+
+// Stdio create one pair stream to params' target, and bridge it with
+// in and out, eg. stdin and stdout when used as ssh ProxyCommand.
+// Return when the pair closed, like netcat, end of input does not close the pair
+func Stdio(ctx context.Context, params *Params, in io.Reader, out io.Writer) error {
+	client := NewClient(params.WsURL)
+	stream, err := client.DialTarget(ctx, paramsTarget(params))
+	if err != nil {
+		return err
+	}
+
+	// ensure pair stream will be closed final
+	defer stream.Close()
+
+	go io.Copy(stream, in)
+
+	_, err = io.Copy(out, stream)
+	return err
+}
@@ -0,0 +1,187 @@
+package endpointc
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"lxport/wsconn"
+)
+
+// udp association idle timeout
+const udpIdleTimeout = 60 * time.Second
+
+// udpPeer source address of an association
+type udpPeer struct {
+	addr net.Addr
+	last time.Time
+}
+
+// serveUDP forward datagrams between local udp port and device via one
+// pair stream, each message is: association id(4) + datagram, each
+// source address is an association, forgotten when idle
+func (f *Forwarder) serveUDP() error {
+	done := make(chan struct{})
+	defer close(done)
+	go f.expireUDPPeers(done)
+
+	b := make([]byte, 65536)
+	for {
+		n, addr, err := f.packetConn.ReadFrom(b[4:])
+		if err != nil {
+			if f.isClosing() {
+				return nil
+			}
+
+			f.log.Println("Forwarder error reading udp: ", err.Error())
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if !f.allowClient(addr) {
+			f.log.Warnf("reject client %s, not in allowlist", addr)
+			continue
+		}
+
+		id, ok := f.udpPeerID(addr)
+		if !ok {
+			continue
+		}
+
+		stream, err := f.udpPairStream()
+		if err != nil {
+			f.log.Printf("serveUDP failed create pair to %s: %v", f.target(), err)
+			continue
+		}
+
+		binary.LittleEndian.PutUint32(b, id)
+		if _, err := stream.Write(b[:4+n]); err != nil {
+			stream.Close()
+		}
+	}
+}
+
+// udpPeerID association id of source address, false if too many associations
+func (f *Forwarder) udpPeerID(addr net.Addr) (uint32, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := addr.String()
+	id, ok := f.udpIDs[key]
+	if !ok {
+		if f.params.MaxConns > 0 && len(f.udpIDs) >= f.params.MaxConns {
+			f.log.Warnf("reject client %s, too many associations:%d", addr, len(f.udpIDs))
+			return 0, false
+		}
+
+		f.udpSeq++
+		id = f.udpSeq
+		f.udpIDs[key] = id
+		f.udpPeers[id] = &udpPeer{addr: addr}
+	}
+
+	f.udpPeers[id].last = time.Now()
+	return id, true
+}
+
+// udpPeerAddr source address of association, nil if forgotten
+func (f *Forwarder) udpPeerAddr(id uint32) net.Addr {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	peer := f.udpPeers[id]
+	if peer == nil {
+		return nil
+	}
+
+	peer.last = time.Now()
+	return peer.addr
+}
+
+// expireUDPPeers forget idle associations
+func (f *Forwarder) expireUDPPeers(done chan struct{}) {
+	ticker := time.NewTicker(udpIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		deadline := time.Now().Add(-udpIdleTimeout)
+		f.lock.Lock()
+		for id, peer := range f.udpPeers {
+			if peer.last.Before(deadline) {
+				delete(f.udpIDs, peer.addr.String())
+				delete(f.udpPeers, id)
+			}
+		}
+		f.lock.Unlock()
+	}
+}
+
+// udpPairStream current pair stream, create one if not exist
+func (f *Forwarder) udpPairStream() (*wsconn.Conn, error) {
+	f.lock.Lock()
+	stream := f.udpStream
+	f.lock.Unlock()
+
+	if stream != nil {
+		return stream, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := f.client.DialTarget(ctx, f.target())
+	if err != nil {
+		return nil, err
+	}
+
+	stream = conn.(*wsconn.Conn)
+	f.lock.Lock()
+	f.udpStream = stream
+	f.lock.Unlock()
+
+	f.log.Printf("udp pair to %s opened", f.target())
+	go f.udpReply(stream)
+
+	return stream, nil
+}
+
+// udpReply read datagrams from pair stream, send them to source address
+func (f *Forwarder) udpReply(stream *wsconn.Conn) {
+	for {
+		message, err := stream.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		if len(message) < 4 {
+			continue
+		}
+
+		addr := f.udpPeerAddr(binary.LittleEndian.Uint32(message[:4]))
+		if addr == nil {
+			continue
+		}
+
+		f.packetConn.WriteTo(message[4:], addr)
+	}
+
+	stream.Close()
+
+	f.lock.Lock()
+	if f.udpStream == stream {
+		f.udpStream = nil
+	}
+	f.lock.Unlock()
+
+	f.log.Printf("udp pair to %s closed", f.target())
+}
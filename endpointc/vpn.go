@@ -0,0 +1,209 @@
+package endpointc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"lxport/tun"
+	"lxport/wsconn"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// VPNLease addresses allocated by server for vpn pair
+type VPNLease struct {
+	// endpoint client address, with prefix length
+	Client string `json:"client"`
+	// device address, with prefix length
+	Device string `json:"device"`
+}
+
+// VPNParams parameters of vpn mode
+type VPNParams struct {
+	// device uuid
+	UUID string
+	// optional, target device pool, take precedence over UUID
+	Pool string
+	// base websocket url
+	WsURL string
+	// optional, networks in device's LAN that routed via vpn,
+	// device must allow them
+	Routes []string
+}
+
+// DialVPN create vpn pair to target, return the pair stream
+// and addresses allocated by server
+func (c *Client) DialVPN(ctx context.Context, target *Target) (*wsconn.Conn, *VPNLease, error) {
+	query := url.Values{}
+	if target.Pool != "" {
+		query.Set("pool", target.Pool)
+	} else {
+		query.Set("uuid", target.Device)
+	}
+	query.Set("pt", "vpn")
+	query.Set("ready", "1")
+
+	ws, _, err := c.dialer.DialContext(ctx, c.wsURL+"?"+query.Encode(), c.header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// server send lease before pairing, close the websocket if ctx is done
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	mt, message, err := ws.ReadMessage()
+	close(done)
+	if err != nil {
+		ws.Close()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, err
+	}
+
+	lease := &VPNLease{}
+	if mt != websocket.TextMessage || json.Unmarshal(message, lease) != nil {
+		ws.Close()
+		return nil, nil, errors.New("vpn failed, invalid lease")
+	}
+
+	err = wsconn.WaitReady(ctx, ws)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return wsconn.New(ws), lease, nil
+}
+
+// VPN carry ip packets between local tun interface and device
+type VPN struct {
+	client *Client
+	params *VPNParams
+	// logger with vpn target
+	log *log.Entry
+
+	// protect stream and closing
+	lock    sync.Mutex
+	stream  *wsconn.Conn
+	closing bool
+}
+
+// NewVPN create vpn
+func NewVPN(params *VPNParams) *VPN {
+	name := params.UUID
+	if params.Pool != "" {
+		name = "@" + params.Pool
+	}
+
+	return &VPN{
+		client: NewClient(params.WsURL),
+		params: params,
+		log:    log.WithField("vpn", name),
+	}
+}
+
+// Serve keep vpn up until Shutdown, reconnect if broken
+func (v *VPN) Serve() error {
+	for !v.isClosing() {
+		err := v.serveOnce()
+		if v.isClosing() {
+			break
+		}
+
+		v.log.Println("VPN down, retry later:", err)
+		time.Sleep(5 * time.Second)
+	}
+
+	return nil
+}
+
+// serveOnce create vpn pair and tun interface,
+// forward packets until either closed
+func (v *VPN) serveOnce() error {
+	target := &Target{Device: v.params.UUID, Pool: v.params.Pool}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	stream, lease, err := v.client.DialVPN(ctx, target)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	defer stream.Close()
+
+	dev, err := tun.Open("lxvpn%d")
+	if err != nil {
+		return err
+	}
+
+	defer dev.Close()
+
+	err = dev.Up(lease.Client)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range v.params.Routes {
+		err = dev.AddRoute(route)
+		if err != nil {
+			v.log.Warnf("VPN add route %s failed:%v", route, err)
+		}
+	}
+
+	if !v.setStream(stream) {
+		return nil
+	}
+	defer v.setStream(nil)
+
+	v.log.Printf("VPN %s(%s) up, device:%s", dev.Name(), lease.Client, lease.Device)
+	wsconn.BridgePackets(stream, dev, tun.MTU, nil)
+
+	return errors.New("vpn pair closed")
+}
+
+// Shutdown close vpn
+func (v *VPN) Shutdown(ctx context.Context) error {
+	v.lock.Lock()
+	v.closing = true
+	stream := v.stream
+	v.lock.Unlock()
+
+	if stream != nil {
+		stream.Close()
+	}
+
+	return nil
+}
+
+// setStream save current stream, return false if shutting down
+func (v *VPN) setStream(stream *wsconn.Conn) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.closing {
+		return false
+	}
+
+	v.stream = stream
+	return true
+}
+
+// isClosing return true if Shutdown has been called
+func (v *VPN) isClosing() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.closing
+}
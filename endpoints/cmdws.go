@@ -1,9 +1,9 @@
 package endpoints
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
-	"net"
 	"sync"
 	"time"
 
@@ -12,6 +12,43 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// command that server send to device
+const (
+	// cmdPairCreate create pair to local port
+	cmdPairCreate = 0
+	// cmdGoingAway server is going away, should reconnect
+	cmdGoingAway = 1
+	// cmdPairCreateExt create pair with kind and meta
+	cmdPairCreateExt = 2
+	// cmdReverseListen listen on local port for reverse forwarding
+	cmdReverseListen = 3
+	// cmdReverseClose close reverse forwarding listener
+	cmdReverseClose = 4
+	// cmdLinkResponse response of link request
+	cmdLinkResponse = 5
+	// cmdUpdate server advertise new build
+	cmdUpdate = 6
+	// cmdConfig server push config document
+	cmdConfig = 7
+)
+
+// how long to wait before reconnect command websocket, doubled up to
+// max each time server rejects device, eg. duplicate uuid
+const (
+	cmdwsRetryInterval = 15 * time.Second
+	cmdwsMaxBackoff    = 10 * time.Minute
+)
+
+// device commands, from device to server
+const (
+	// devLinkRequest request to link to another device
+	devLinkRequest = 0x80
+	// devConfigAck acknowledge config document
+	devConfigAck = 0x81
+	// devReverseAck result of reverse listen
+	devReverseAck = 0x82
+)
+
 type wsholder struct {
 	// unique id, as wsholder object's identifier
 	uuid string
@@ -48,42 +85,73 @@ func newHolder(uuid string, c *websocket.Conn) *wsholder {
 }
 
 // buildCmdWS build a websocket dedicated to recv command
-func buildCmdWS() (*wsholder, error) {
-	c, _, err := websocket.DefaultDialer.Dial(wsURLRegister, nil)
+func (a *Agent) buildCmdWS(ctx context.Context) (*wsholder, error) {
+	// report applied config version, server push config if differ
+	wsURL := fmt.Sprintf("%s&cfg=%d", a.wsURLRegister, a.currentConfigVersion())
+	c, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	wh := newHolder(deviceID, c)
+	wh := newHolder(a.deviceID, c)
 	return wh, nil
 }
 
-// cmdwsService long run service, never return
-func cmdwsService() {
-	// never return
-	for {
+// cmdwsService long run service, return only when ctx done or draining
+func (a *Agent) cmdwsService(ctx context.Context) {
+	backoff := cmdwsRetryInterval
+	for ctx.Err() == nil && !a.isDraining() {
 		// build/re-build command websocket
-		wh, err := buildCmdWS()
+		wh, err := a.buildCmdWS(ctx)
 		if err != nil {
 			log.Println("cmdwsService reconnect later, buildCmdWS failed:", err)
-			time.Sleep(15 * time.Second)
+			select {
+			case <-ctx.Done():
+			case <-time.After(cmdwsRetryInterval):
+			}
 			continue
 		}
 
-		wh.loop()
+		// new binary works, if just updated
+		a.commitUpdate()
+
+		err = a.loop(wh)
+		if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			backoff = cmdwsRetryInterval
+			continue
+		}
+
+		// rejected, eg. another device with the same uuid is online
+		log.Errorf("cmdwsService rejected by server:%v, retry in %s", err, backoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > cmdwsMaxBackoff {
+			backoff = cmdwsMaxBackoff
+		}
 	}
 }
 
 // write write bytes array to websocket with message type
 func (wh *wsholder) write(mt int, data []byte) error {
-	if wh.conn == nil {
+	conn := wh.conn
+	if conn == nil {
 		return fmt.Errorf("wsholder write failed, no ws connection")
 	}
 
+	// control message can be written concurrently with
+	// data message, which may be written by stream handler
+	if mt == websocket.PingMessage || mt == websocket.PongMessage {
+		return conn.WriteControl(mt, data, time.Now().Add(10*time.Second))
+	}
+
 	// lock, ensure only one goroutine can write to
 	// websocket in the same time
 	wh.writeLock.Lock()
-	err := wh.conn.WriteMessage(mt, data)
+	err := conn.WriteMessage(mt, data)
 	wh.writeLock.Unlock()
 
 	return err
@@ -93,7 +161,6 @@ func (wh *wsholder) write(mt int, data []byte) error {
 func (wh *wsholder) close() {
 	if wh.conn != nil {
 		wh.conn.Close()
-		wh.conn = nil
 	}
 }
 
@@ -127,14 +194,17 @@ func (wh *wsholder) keepalive() {
 	wh.waitingPingCount++
 }
 
-// loop read command websocket and process command
-func (wh *wsholder) loop() {
+// loop read command websocket and process command, return read error
+// that ends it
+func (a *Agent) loop(wh *wsholder) error {
 	// save to map, for keep-alive
-	wsholderMap[wh.uuid] = wh
+	a.addHolder(wh)
 	ws := wh.conn
 
+	var err error
 	for {
-		_, message, err := ws.ReadMessage()
+		var message []byte
+		_, message, err = ws.ReadMessage()
 		if err != nil {
 			log.Println("wsholder handleRequest ws read error:", err)
 			ws.Close()
@@ -143,115 +213,32 @@ func (wh *wsholder) loop() {
 
 		ops := message[0]
 		switch ops {
-		case 0:
-			go onPairRequest(wh, message)
+		case cmdPairCreate:
+			go a.onPairRequest(message)
+		case cmdPairCreateExt:
+			go a.onPairRequestExt(message)
+		case cmdReverseListen:
+			a.onReverseListen(message)
+		case cmdReverseClose:
+			a.onReverseClose(message)
+		case cmdLinkResponse:
+			a.onLinkResponse(message)
+		case cmdUpdate:
+			a.onUpdate(message)
+		case cmdConfig:
+			a.onConfig(message)
+		case cmdGoingAway:
+			// reconnect, maybe to another server
+			log.Println("wsholder server is going away, reconnect")
+			ws.Close()
 		default:
 			log.Errorf("wsholder unsupport operation:%d", ops)
 		}
 	}
 	// remove from map
-	delete(wsholderMap, wh.uuid)
-}
-
-// onPairRequest connect to local port via tcp,
-// and then connect to server via websocket, bridge the two connections.
-func onPairRequest(_ *wsholder, message []byte) {
-	// target port
-	port := binary.LittleEndian.Uint16(message[1:3])
-	// pair uuid
-	uuid := message[3:]
-
-	// only allow connect to local host
-	address := fmt.Sprintf("127.0.0.1:%d", port)
-
-	// connect to local network via tcp
-	conn, err := net.Dial("tcp", address)
-	if err != nil {
-		log.Errorf("onPairRequest connect to address:%s failed:%v", address, err)
-		return
-	}
-
-	// ensure the tcp connection will closed final
-	defer conn.Close()
-
-	// connect to server via websocket
-	wsURLResp := fmt.Sprintf("%s?pt=resp&uuid=%s", wsURLBase, string(uuid))
-	ws, _, err := websocket.DefaultDialer.Dial(wsURLResp, nil)
-	if err != nil {
-		log.Println("onPairRequest failed connect to websocket server:", err)
-		return
-	}
+	a.removeHolder(wh)
+	// server has forgotten reverse listeners
+	a.closeReverses()
 
-	// use pair's uuid as wsholder's identifier
-	wh := newHolder(string(uuid), ws)
-	// save to map, for keep-alive
-	wsholderMap[wh.uuid] = wh
-
-	// ensure the websocket will be closed final, and remove from map
-	defer func() {
-		wh.close()
-		delete(wsholderMap, wh.uuid)
-	}()
-
-	// receive websocket message and forward to tcp
-	go func() {
-		for {
-			_, message, err := ws.ReadMessage()
-			if err != nil {
-				log.Println("onPairRequest ws read error:", err)
-				conn.Close()
-				break
-			}
-
-			writeAll(conn, message)
-			if err != nil {
-				break
-			}
-		}
-	}()
-
-	// receive tcp message and forward to websocket
-	tcpbuf := make([]byte, 256*1024)
-	// encoded := make([]byte, 256*1024)
-	for {
-		n, err := conn.Read(tcpbuf)
-		if err != nil {
-			log.Println("onPairRequest tcp read error:", err)
-			ws.Close()
-			break
-		}
-
-		// encode snappy
-		// sout := snappy.Encode(encoded, tcpbuf[:n])
-		err = wh.write(websocket.BinaryMessage, tcpbuf[:n])
-		if err != nil {
-			log.Println("onPairRequest ws write error:", err)
-			break
-		}
-	}
-}
-
-// writeAll a function that ensure all bytes write out
-// maybe it is unnecessary, if the underlying tcp connection has ensure that
-func writeAll(conn net.Conn, buf []byte) error {
-	wrote := 0
-	l := len(buf)
-	for {
-		n, err := conn.Write(buf[wrote:])
-		if err != nil {
-			return err
-		}
-
-		if n == 0 {
-			// this should not happen
-			break
-		}
-
-		wrote = wrote + n
-		if wrote == l {
-			break
-		}
-	}
-
-	return nil
+	return err
 }
@@ -0,0 +1,178 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config device config document, pushed by server and persisted locally
+type Config struct {
+	// version of the document
+	Version int64 `json:"version"`
+	// optional, local ports that pair can connect to, all ports if empty
+	Ports []uint16 `json:"ports,omitempty"`
+	// optional, networks in device's LAN that pair can connect to,
+	// replace AllowLAN of params if provided
+	LAN []string `json:"lan,omitempty"`
+	// optional, log level, eg. debug, info, warn
+	LogLevel string `json:"logLevel,omitempty"`
+	// optional, keepalive interval in seconds
+	Keepalive int `json:"keepalive,omitempty"`
+}
+
+// configAck acknowledge config document to server
+type configAck struct {
+	Version int64  `json:"version"`
+	Error   string `json:"error,omitempty"`
+}
+
+// applyConfig validate config document and apply it atomically,
+// nothing changed if any field is invalid
+func (a *Agent) applyConfig(doc []byte) (*Config, error) {
+	cfg := &Config{}
+	err := json.Unmarshal(doc, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var allowPorts map[uint16]bool
+	if len(cfg.Ports) > 0 {
+		allowPorts = make(map[uint16]bool)
+		for _, p := range cfg.Ports {
+			allowPorts[p] = true
+		}
+	}
+
+	allowLAN := a.paramsLAN
+	if cfg.LAN != nil {
+		allowLAN = nil
+		for _, cidr := range cfg.LAN {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid LAN network %s", cidr)
+			}
+			allowLAN = append(allowLAN, n)
+		}
+	}
+
+	level := log.GetLevel()
+	if cfg.LogLevel != "" {
+		level, err = log.ParseLevel(cfg.LogLevel)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	interval := defaultKeepalive
+	if cfg.Keepalive < 0 {
+		return cfg, fmt.Errorf("invalid keepalive %d", cfg.Keepalive)
+	} else if cfg.Keepalive > 0 {
+		interval = time.Duration(cfg.Keepalive) * time.Second
+	}
+
+	a.lock.Lock()
+	a.configVersion = cfg.Version
+	a.allowPorts = allowPorts
+	a.allowLAN = allowLAN
+	a.keepaliveInterval = interval
+	a.lock.Unlock()
+
+	log.SetLevel(level)
+
+	return cfg, nil
+}
+
+// onConfig server push config document, packet: op(1) + json Config,
+// apply and persist it, then acknowledge
+func (a *Agent) onConfig(message []byte) {
+	ack := &configAck{}
+
+	cfg, err := a.applyConfig(message[1:])
+	if cfg != nil {
+		ack.Version = cfg.Version
+	}
+
+	if err != nil {
+		log.Errorf("onConfig reject config version %d:%v", ack.Version, err)
+		ack.Error = err.Error()
+	} else {
+		log.Printf("onConfig applied config version %d", ack.Version)
+		if err := a.saveConfig(message[1:]); err != nil {
+			log.Errorf("onConfig save config failed:%v", err)
+		}
+	}
+
+	b, _ := json.Marshal(ack)
+
+	a.lock.Lock()
+	cmdws := a.wsholderMap[a.deviceID]
+	a.lock.Unlock()
+
+	if cmdws != nil {
+		cmdws.write(websocket.BinaryMessage, append([]byte{devConfigAck}, b...))
+	}
+}
+
+// loadConfig apply persisted config document, if any
+func (a *Agent) loadConfig() {
+	if a.configFile == "" {
+		return
+	}
+
+	doc, err := ioutil.ReadFile(a.configFile)
+	if err != nil {
+		return
+	}
+
+	cfg, err := a.applyConfig(doc)
+	if err != nil {
+		log.Errorf("loadConfig %s invalid:%v", a.configFile, err)
+		return
+	}
+
+	log.Printf("loadConfig %s version %d", a.configFile, cfg.Version)
+}
+
+// saveConfig persist config document, replace old one atomically
+func (a *Agent) saveConfig(doc []byte) error {
+	if a.configFile == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(a.configFile), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp := a.configFile + ".tmp"
+	err = writeFileSync(tmp, doc, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, a.configFile)
+}
+
+// allowPort check if local port is allowed by config
+func (a *Agent) allowPort(port uint16) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.allowPorts == nil || a.allowPorts[port]
+}
+
+// currentConfigVersion version of applied config, 0 if none
+func (a *Agent) currentConfigVersion() int64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.configVersion
+}
@@ -1,55 +1,363 @@
 package endpoints
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"fmt"
+	"net"
+	"net/url"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-var (
+// default keepalive interval
+const defaultKeepalive = 30 * time.Second
+
+// Params parameters
+type Params struct {
+	// device id
+	UUID string
+	// base websocket url
+	WsURL string
+	// optional, pool that the device join
+	Pool string
+	// optional, networks(CIDR) in device's LAN that
+	// pair can connect to, besides localhost
+	AllowLAN []string
+	// optional, links "lport:device:rport" that local port
+	// forward to port of another device, "@name" as device means pool
+	Links []string
+	// optional, accept vpn pair, packets to AllowLAN are forwarded
+	VPN bool
+	// optional, shell that web terminal can open on device, eg. bash,
+	// empty disables remote shell
+	Shell string
+	// optional, commands that server can execute, an entry allows
+	// commands start with its fields, eg. "systemctl status", empty
+	// disables exec
+	ExecAllow []string
+	// optional, directories that files can be transferred under,
+	// empty disables file transfer
+	FileRoots []string
+
+	// optional, version of running binary, reported to server
+	Version string
+	// optional, base64 ed25519 public key that new build must be
+	// signed with, empty disables update
+	UpdateKey string
+	// optional, new build must register in it, or roll back, default 60s
+	UpdateDeadline time.Duration
+
+	// optional, file that config pushed by server persisted to,
+	// loaded when start
+	ConfigFile string
+}
+
+// Handler serve pair stream of a port
+type Handler interface {
+	ServeConn(conn net.Conn)
+}
+
+// HandlerFunc adapter to allow ordinary function as Handler
+type HandlerFunc func(conn net.Conn)
+
+// ServeConn call f(conn)
+func (f HandlerFunc) ServeConn(conn net.Conn) {
+	f(conn)
+}
+
+// Agent endpoint server, register to server and
+// serve pair create request
+type Agent struct {
 	// the device id
 	deviceID string
+	// pool that the device join
+	pool string
 	// websocket url, that is
 	// base websocket url concatenated with device id
 	wsURLRegister string
 	// base websocket url
 	wsURLBase string
 
+	// protect handlers and wsholderMap
+	lock sync.Mutex
+	// handlers index by port, port without handler
+	// will be bridged to local tcp port
+	handlers map[uint16]Handler
 	// map keep all current websocket
 	// use for keep-alive
-	wsholderMap = make(map[string]*wsholder)
-)
+	wsholderMap map[string]*wsholder
+	// networks in device's LAN that pair can connect to
+	allowLAN []*net.IPNet
+	// networks of params, used if config not provide
+	paramsLAN []*net.IPNet
+	// local ports that pair can connect to, nil means all
+	allowPorts map[uint16]bool
+	// version of applied config
+	configVersion int64
+	// file that config persisted to
+	configFile string
+	// keepalive interval
+	keepaliveInterval time.Duration
+	// reverse forwarding listeners index by reverse id
+	reverses map[string]net.Listener
+	// accept vpn pair
+	vpn bool
+	// shell for web terminal, empty if disabled
+	shell string
+	// allowed commands of exec
+	execAllow []string
+	// root directories of file transfer
+	fileRoots []string
 
-// Params parameters
-type Params struct {
-	// device id
-	UUID string
-	// base websocket url
-	WsURL string
+	// version of running binary
+	version string
+	// public key that new build must be signed with
+	updateKey ed25519.PublicKey
+	// new build must register in it
+	updateDeadline time.Duration
+	// set when updating, access atomically
+	updating int32
+	// binary path if just updated and not registered yet
+	updateExe string
+	// links to other devices
+	links []*link
+	// link requests that waiting server's response, index by request id
+	linkWaits map[uint32]chan *linkResponse
+	// last link request id, access atomically
+	linkSeq uint32
+	// cancel the context of Run
+	cancel context.CancelFunc
+
+	// set when shutting down, access atomically
+	draining int32
+	// current pair stream count, access atomically
+	activeStreams int32
+}
+
+// NewAgent create endpoint server agent
+func NewAgent(params *Params) *Agent {
+	a := &Agent{
+		deviceID:    params.UUID,
+		pool:        params.Pool,
+		vpn:         params.VPN,
+		shell:       params.Shell,
+		execAllow:   params.ExecAllow,
+		fileRoots:   params.FileRoots,
+		wsURLBase:   params.WsURL,
+		handlers:    make(map[uint16]Handler),
+		wsholderMap: make(map[string]*wsholder),
+		reverses:    make(map[string]net.Listener),
+		linkWaits:   make(map[uint32]chan *linkResponse),
+
+		version:        params.Version,
+		updateDeadline: params.UpdateDeadline,
+
+		configFile:        params.ConfigFile,
+		keepaliveInterval: defaultKeepalive,
+	}
+
+	if a.updateDeadline <= 0 {
+		a.updateDeadline = 60 * time.Second
+	}
+
+	if params.UpdateKey != "" {
+		key, err := base64.StdEncoding.DecodeString(params.UpdateKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			log.Errorf("NewAgent invalid update key, update disabled")
+		} else {
+			a.updateKey = ed25519.PublicKey(key)
+		}
+	}
+
+	for _, cidr := range params.AllowLAN {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Errorf("NewAgent invalid LAN network:%s, %v", cidr, err)
+			continue
+		}
+		a.allowLAN = append(a.allowLAN, n)
+	}
+	a.paramsLAN = a.allowLAN
+
+	for _, s := range params.Links {
+		l, err := parseLink(s)
+		if err != nil {
+			log.Errorf("NewAgent %v", err)
+			continue
+		}
+		a.links = append(a.links, l)
+	}
+
+	// config of last run
+	a.loadConfig()
+
+	a.wsURLRegister = fmt.Sprintf("%s?pt=dev&uuid=%s&ver=%s&os=%s&arch=%s", params.WsURL, params.UUID,
+		url.QueryEscape(params.Version), runtime.GOOS, runtime.GOARCH)
+	if params.Pool != "" {
+		a.wsURLRegister = fmt.Sprintf("%s&pool=%s", a.wsURLRegister, url.QueryEscape(params.Pool))
+	}
+
+	return a
+}
+
+// Handle register handler for port, pair stream to the port
+// will be served by handler instead of local tcp port
+func (a *Agent) Handle(port uint16, handler Handler) {
+	a.lock.Lock()
+	a.handlers[port] = handler
+	a.lock.Unlock()
+}
+
+// HandleFunc register handler function for port
+func (a *Agent) HandleFunc(port uint16, handler func(conn net.Conn)) {
+	a.Handle(port, HandlerFunc(handler))
+}
+
+// handler get handler of port, nil if not registered
+func (a *Agent) handler(port uint16) Handler {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.handlers[port]
+}
+
+// addHolder save websocket holder, for keep-alive
+func (a *Agent) addHolder(wh *wsholder) {
+	a.lock.Lock()
+	a.wsholderMap[wh.uuid] = wh
+	a.lock.Unlock()
+}
+
+// removeHolder remove websocket holder
+func (a *Agent) removeHolder(wh *wsholder) {
+	a.lock.Lock()
+	if a.wsholderMap[wh.uuid] == wh {
+		delete(a.wsholderMap, wh.uuid)
+	}
+	a.lock.Unlock()
+}
+
+// holders snapshot of all websocket holders
+func (a *Agent) holders() []*wsholder {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	whs := make([]*wsholder, 0, len(a.wsholderMap))
+	for _, v := range a.wsholderMap {
+		whs = append(whs, v)
+	}
+
+	return whs
 }
 
 // keepalive send ping to all websocket holder
-func keepalive() {
+func (a *Agent) keepalive(ctx context.Context) {
 	for {
-		time.Sleep(time.Second * 30)
+		a.lock.Lock()
+		interval := a.keepaliveInterval
+		a.lock.Unlock()
 
-		for _, v := range wsholderMap {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		for _, v := range a.holders() {
 			v.keepalive()
 		}
 	}
 }
 
-// Run run endpoint server and
-// wait for server's command
-func Run(params *Params) {
-	deviceID = params.UUID
-	wsURLRegister = fmt.Sprintf("%s?pt=dev&uuid=%s", params.WsURL, deviceID)
-	wsURLBase = params.WsURL
+// Run register to server and wait for server's command,
+// return when ctx is done or Shutdown completed, all websockets are closed then
+func (a *Agent) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	a.lock.Lock()
+	a.cancel = cancel
+	a.lock.Unlock()
 
 	// keep-alive goroutine
-	go keepalive()
+	go a.keepalive(ctx)
+
+	// roll back if just updated and not register in time
+	a.checkUpdateMarker()
+
+	// listen for links to other devices
+	a.startLinks()
 
-	log.Printf("endpoint run, device uuid:%s", deviceID)
-	cmdwsService()
+	// close all websocket when ctx done
+	go func() {
+		<-ctx.Done()
+		a.closeLinks()
+		for _, v := range a.holders() {
+			v.close()
+		}
+	}()
+
+	log.Printf("endpoint run, device uuid:%s, pool:%s", a.deviceID, a.pool)
+	a.cmdwsService(ctx)
+
+	// command websocket stop by Shutdown, wait streams drained
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Shutdown unregister from server, so that no more pairs will be created,
+// and wait existing pair streams to end. When ctx is done, all remaining
+// streams are closed, and Run returns
+func (a *Agent) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&a.draining, 1)
+
+	// close command websocket, server will remove this device
+	a.lock.Lock()
+	cmdws := a.wsholderMap[a.deviceID]
+	cancel := a.cancel
+	a.lock.Unlock()
+
+	if cmdws != nil {
+		cmdws.close()
+	}
+
+	// no more reverse and link connections
+	a.closeReverses()
+	a.closeLinks()
+
+	if cancel != nil {
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for n := atomic.LoadInt32(&a.activeStreams); n > 0; n = atomic.LoadInt32(&a.activeStreams) {
+		select {
+		case <-ctx.Done():
+			log.Warnf("endpoint drain deadline, close %d streams", n)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	log.Println("endpoint shutdown completed")
+	return nil
+}
+
+// isDraining return true if Shutdown has been called
+func (a *Agent) isDraining() bool {
+	return atomic.LoadInt32(&a.draining) != 0
+}
+
+// Run run endpoint server and
+// wait for server's command
+func Run(params *Params) {
+	NewAgent(params).Run(context.Background())
 }
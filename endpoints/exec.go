@@ -0,0 +1,174 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"lxport/wsconn"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// exec message ops, to server: op(1) + payload
+const (
+	// execOpExit exit with json execResult, the last message
+	execOpExit = 0
+	// execOpStdout stdout data
+	execOpStdout = 1
+	// execOpStderr stderr data
+	execOpStderr = 2
+)
+
+// default timeout of exec, if server not provided
+const execDefaultTimeout = 60 * time.Second
+
+// execResult exit status of command
+type execResult struct {
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+// execWriter write command output to pair as op + data message
+type execWriter struct {
+	stream *wsconn.Conn
+	op     byte
+}
+
+func (w *execWriter) Write(b []byte) (int, error) {
+	message := make([]byte, len(b)+1)
+	message[0] = w.op
+	copy(message[1:], b)
+
+	_, err := w.stream.Write(message)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// allowExec check command against allowlist, an entry allows commands
+// that start with its fields, eg. "systemctl status" allows
+// "systemctl status foo" but not "systemctl stop foo"
+func (a *Agent) allowExec(command []string) bool {
+	for _, entry := range a.execAllow {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 || len(fields) > len(command) {
+			continue
+		}
+
+		match := true
+		for i, f := range fields {
+			if command[i] != f {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveExec execute command in meta without shell, stream stdout and stderr
+// to the pair, then exit status. Command not in allowlist is rejected
+func (a *Agent) serveExec(uuid string, meta *pairMeta) {
+	if a.isDraining() {
+		log.Println("serveExec ignore, endpoint is draining")
+		return
+	}
+
+	atomic.AddInt32(&a.activeStreams, 1)
+	defer atomic.AddInt32(&a.activeStreams, -1)
+
+	conn, err := a.dialPairResponse(uuid)
+	if err != nil {
+		log.Println("serveExec failed connect to websocket server:", err)
+		return
+	}
+
+	stream := conn.(*wsconn.Conn)
+	defer stream.Close()
+
+	// server close the pair if request canceled
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, err := stream.ReadMessage(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	result := a.runExec(stream, meta, closed)
+
+	b, _ := json.Marshal(result)
+	stream.Write(append([]byte{execOpExit}, b...))
+}
+
+// runExec run command, output to stream, killed if closed
+func (a *Agent) runExec(stream *wsconn.Conn, meta *pairMeta, closed chan struct{}) *execResult {
+	if len(meta.Command) == 0 {
+		return &execResult{Code: -1, Error: "empty command"}
+	}
+
+	if !a.allowExec(meta.Command) {
+		log.Warnf("serveExec command not allowed:%v", meta.Command)
+		return &execResult{Code: -1, Error: "command not allowed"}
+	}
+
+	timeout := execDefaultTimeout
+	if meta.Timeout > 0 {
+		timeout = time.Duration(meta.Timeout) * time.Second
+	}
+
+	cmd := exec.Command(meta.Command[0], meta.Command[1:]...)
+	cmd.Stdout = &execWriter{stream: stream, op: execOpStdout}
+	cmd.Stderr = &execWriter{stream: stream, op: execOpStderr}
+	prepareExec(cmd)
+
+	log.Printf("serveExec run:%v, timeout:%s", meta.Command, timeout)
+	err := cmd.Start()
+	if err != nil {
+		return &execResult{Code: -1, Error: err.Error()}
+	}
+
+	// kill command and its children when timeout, or pair closed
+	var timedOut int32
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-time.After(timeout):
+			atomic.StoreInt32(&timedOut, 1)
+		case <-closed:
+		}
+		killExec(cmd)
+	}()
+
+	err = cmd.Wait()
+	close(done)
+
+	if atomic.LoadInt32(&timedOut) != 0 {
+		return &execResult{Code: -1, Error: "timeout"}
+	}
+
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return &execResult{Code: exitErr.ExitCode()}
+		}
+		return &execResult{Code: -1, Error: err.Error()}
+	}
+
+	return &execResult{Code: 0}
+}
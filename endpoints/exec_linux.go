@@ -0,0 +1,17 @@
+package endpoints
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// prepareExec run command in its own process group,
+// so that its children can be killed with it
+func prepareExec(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killExec kill command and its children
+func killExec(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
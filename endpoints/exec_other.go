@@ -0,0 +1,17 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package endpoints
+
+import (
+	"os/exec"
+)
+
+// prepareExec nothing to do on this platform
+func prepareExec(cmd *exec.Cmd) {
+}
+
+// killExec kill command
+func killExec(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,47 @@
+package endpoints
+
+import "testing"
+
+func TestAllowExec(t *testing.T) {
+	a := &Agent{
+		execAllow: []string{
+			"uptime",
+			"systemctl status",
+			"  df   -h  ",
+			"",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		command []string
+		allow   bool
+	}{
+		{"exact", []string{"uptime"}, true},
+		{"extra args", []string{"uptime", "-p"}, true},
+		{"prefix fields", []string{"systemctl", "status", "nginx"}, true},
+		{"spaces of entry", []string{"df", "-h", "/"}, true},
+		{"other subcommand", []string{"systemctl", "stop", "nginx"}, false},
+		{"shorter than entry", []string{"systemctl"}, false},
+		{"partial field", []string{"uptimex"}, false},
+		{"field with space", []string{"systemctl status"}, false},
+		{"path of allowed", []string{"/usr/bin/uptime"}, false},
+		{"shell", []string{"sh", "-c", "uptime"}, false},
+		{"empty entry match nothing", []string{""}, false},
+		{"empty command", nil, false},
+		{"case", []string{"Uptime"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := a.allowExec(tt.command); got != tt.allow {
+			t.Errorf("%s: allowExec(%q) = %v, want %v", tt.name, tt.command, got, tt.allow)
+		}
+	}
+}
+
+func TestAllowExecEmptyList(t *testing.T) {
+	a := &Agent{}
+	if a.allowExec([]string{"uptime"}) {
+		t.Error("allowExec with empty allowlist should refuse")
+	}
+}
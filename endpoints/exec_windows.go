@@ -0,0 +1,14 @@
+package endpoints
+
+import (
+	"os/exec"
+)
+
+// prepareExec nothing to do on windows
+func prepareExec(cmd *exec.Cmd) {
+}
+
+// killExec kill command
+func killExec(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
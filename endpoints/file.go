@@ -0,0 +1,433 @@
+package endpoints
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"lxport/wsconn"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// file request ops
+const (
+	// fileOpGet read file from offset
+	fileOpGet = "get"
+	// fileOpPut write file, resume from partial file if any
+	fileOpPut = "put"
+	// fileOpList list directory
+	fileOpList = "list"
+	// fileOpSum size and sha256 of file
+	fileOpSum = "sum"
+)
+
+// size of data message of file transfer
+const fileChunkSize = 32 * 1024
+
+// suffix of partial file that put writes to
+const filePartSuffix = ".part"
+
+// errFileNotAllowed path is not under any root directory
+var errFileNotAllowed = errors.New("path not allowed")
+
+// fileRequest the first message of file pair
+type fileRequest struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// get: offset to read from
+	Offset int64 `json:"offset,omitempty"`
+	// get: response sha256 of the whole file
+	Sum bool `json:"sum,omitempty"`
+	// put: size and sha256 of the file to write
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// fileInfo file or directory entry
+type fileInfo struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Mode    uint32 `json:"mode"`
+	ModTime int64  `json:"modTime"`
+	Dir     bool   `json:"dir,omitempty"`
+}
+
+// fileResponse response of file request, data messages follow that of get
+// and put, an empty message marks the end
+type fileResponse struct {
+	Error string `json:"error,omitempty"`
+	// get, sum, and final response of put: size of file
+	Size int64 `json:"size"`
+	// get and put: offset that data is sent from
+	Offset int64  `json:"offset,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// list: entries of directory
+	Entries []*fileInfo `json:"entries,omitempty"`
+}
+
+// filePath check path is under a root directory, symbolic links are
+// resolved so that they can not escape root. If create, path itself
+// needs not exist, but is resolved too if it does
+func (a *Agent) filePath(path string, create bool) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", errors.New("path must be absolute")
+	}
+
+	path = filepath.Clean(path)
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if create && os.IsNotExist(err) {
+		resolved, err = filepath.EvalSymlinks(filepath.Dir(path))
+		resolved = filepath.Join(resolved, filepath.Base(path))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for _, root := range a.fileRoots {
+		r, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+
+		rel, err := filepath.Rel(r, resolved)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+
+		return resolved, nil
+	}
+
+	return "", errFileNotAllowed
+}
+
+// serveFile serve file pair, the first message is json fileRequest,
+// response json fileResponse, followed by data messages if any
+func (a *Agent) serveFile(uuid string) {
+	if a.isDraining() {
+		log.Println("serveFile ignore, endpoint is draining")
+		return
+	}
+
+	atomic.AddInt32(&a.activeStreams, 1)
+	defer atomic.AddInt32(&a.activeStreams, -1)
+
+	conn, err := a.dialPairResponse(uuid)
+	if err != nil {
+		log.Println("serveFile failed connect to websocket server:", err)
+		return
+	}
+
+	stream := conn.(*wsconn.Conn)
+	defer stream.Close()
+
+	message, err := stream.ReadMessage()
+	if err != nil {
+		log.Println("serveFile read request failed:", err)
+		return
+	}
+
+	req := &fileRequest{}
+	err = json.Unmarshal(message, req)
+	if err != nil {
+		writeFileResponse(stream, &fileResponse{Error: "invalid request"})
+		return
+	}
+
+	if len(a.fileRoots) == 0 {
+		log.Warnf("serveFile %s %s, file transfer disabled", req.Op, req.Path)
+		writeFileResponse(stream, &fileResponse{Error: "file transfer disabled"})
+		return
+	}
+
+	log.Printf("serveFile %s %s, offset:%d", req.Op, req.Path, req.Offset)
+	switch req.Op {
+	case fileOpGet:
+		err = a.fileGet(stream, req)
+	case fileOpPut:
+		err = a.filePut(stream, req)
+	case fileOpList:
+		err = a.fileList(stream, req)
+	case fileOpSum:
+		err = a.fileSum(stream, req)
+	default:
+		err = fmt.Errorf("unsupported op %s", req.Op)
+	}
+
+	if err != nil {
+		log.Errorf("serveFile %s %s failed:%v", req.Op, req.Path, err)
+		writeFileResponse(stream, &fileResponse{Error: err.Error()})
+	}
+}
+
+// writeFileResponse write json response as one message
+func writeFileResponse(stream *wsconn.Conn, resp *fileResponse) error {
+	b, _ := json.Marshal(resp)
+	_, err := stream.Write(b)
+	return err
+}
+
+// fileGet send file from offset, size is fixed at open so that growing
+// file, eg. log, is sent consistently
+func (a *Agent) fileGet(stream *wsconn.Conn, req *fileRequest) error {
+	path, err := a.filePath(req.Path, false)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if st.IsDir() {
+		return errors.New("is a directory")
+	}
+
+	size := st.Size()
+	if req.Offset < 0 {
+		return fmt.Errorf("invalid offset %d", req.Offset)
+	}
+
+	offset := req.Offset
+	if offset > size {
+		// partial file of client is not of this file, start over
+		offset = 0
+	}
+
+	resp := &fileResponse{Size: size, Offset: offset}
+	if req.Sum {
+		resp.SHA256, err = sumReader(io.NewSectionReader(f, 0, size))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeFileResponse(stream, resp)
+	if err != nil {
+		return nil
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil
+	}
+
+	b := make([]byte, fileChunkSize)
+	r := io.LimitReader(f, size-offset)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if _, err := stream.Write(b[:n]); err != nil {
+				return nil
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			// response has been sent, just close the pair
+			log.Errorf("serveFile read %s failed:%v", path, err)
+			return nil
+		}
+	}
+
+	// end of data
+	stream.Write([]byte{})
+	return nil
+}
+
+// filePut receive file to partial file, appended to what already received,
+// then verify and rename it to path
+func (a *Agent) filePut(stream *wsconn.Conn, req *fileRequest) error {
+	path, err := a.filePath(req.Path, true)
+	if err != nil {
+		return err
+	}
+
+	if req.Size < 0 || req.SHA256 == "" {
+		return errors.New("need size and sha256")
+	}
+
+	part := path + filePartSuffix
+	f, err := openPart(part)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if offset > req.Size {
+		// not the same file, start over
+		offset = 0
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	err = writeFileResponse(stream, &fileResponse{Offset: offset})
+	if err != nil {
+		return nil
+	}
+
+	for {
+		message, err := stream.ReadMessage()
+		if err != nil {
+			// keep partial file, resume later
+			log.Printf("serveFile put %s interrupted at %d", path, offset)
+			return nil
+		}
+
+		if len(message) == 0 {
+			break
+		}
+
+		if offset+int64(len(message)) > req.Size {
+			return errors.New("exceed size")
+		}
+
+		_, err = f.Write(message)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(message))
+	}
+
+	if offset != req.Size {
+		return fmt.Errorf("incomplete, got %d of %d", offset, req.Size)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	sum, err := sumReader(io.NewSectionReader(f, 0, offset))
+	if err != nil {
+		return err
+	}
+
+	if sum != req.SHA256 {
+		f.Close()
+		os.Remove(part)
+		return errors.New("sha256 mismatch")
+	}
+
+	f.Close()
+	err = os.Rename(part, path)
+	if err != nil {
+		return err
+	}
+
+	return writeFileResponse(stream, &fileResponse{Size: offset, SHA256: sum})
+}
+
+// openPart open or create partial file, that must be a regular file,
+// so that a symbolic link can not redirect writes out of root
+func openPart(part string) (*os.File, error) {
+	if fi, err := os.Lstat(part); err == nil && !fi.Mode().IsRegular() {
+		return nil, errFileNotAllowed
+	}
+
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// replaced between check and open
+	fi, err := f.Stat()
+	li, lerr := os.Lstat(part)
+	if err != nil || lerr != nil || !li.Mode().IsRegular() || !os.SameFile(fi, li) {
+		f.Close()
+		return nil, errFileNotAllowed
+	}
+
+	return f, nil
+}
+
+// fileList list directory
+func (a *Agent) fileList(stream *wsconn.Conn, req *fileRequest) error {
+	path, err := a.filePath(req.Path, false)
+	if err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	resp := &fileResponse{Entries: make([]*fileInfo, 0, len(infos))}
+	for _, fi := range infos {
+		resp.Entries = append(resp.Entries, &fileInfo{
+			Name:    fi.Name(),
+			Size:    fi.Size(),
+			Mode:    uint32(fi.Mode()),
+			ModTime: fi.ModTime().Unix(),
+			Dir:     fi.IsDir(),
+		})
+	}
+
+	return writeFileResponse(stream, resp)
+}
+
+// fileSum size and sha256 of file
+func (a *Agent) fileSum(stream *wsconn.Conn, req *fileRequest) error {
+	path, err := a.filePath(req.Path, false)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	sum, err := sumReader(io.NewSectionReader(f, 0, st.Size()))
+	if err != nil {
+		return err
+	}
+
+	return writeFileResponse(stream, &fileResponse{Size: st.Size(), SHA256: sum})
+}
+
+// sumReader hex sha256 of all data of r
+func sumReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,158 @@
+package endpoints
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilePath(t *testing.T) {
+	base, err := ioutil.TempDir("", "lxport-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	// base/root is allowed, base/root2 and base/secret are not
+	base, _ = filepath.EvalSymlinks(base)
+	root := filepath.Join(base, "root")
+	for _, dir := range []string{root, filepath.Join(root, "sub"), filepath.Join(base, "root2")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, f := range []string{filepath.Join(root, "a.txt"), filepath.Join(base, "secret"), filepath.Join(base, "root2", "b.txt")} {
+		if err := ioutil.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"out":     filepath.Join(base, "secret"),
+		"outdir":  base,
+		"in":      filepath.Join(root, "a.txt"),
+		"dangle":  filepath.Join(base, "none"),
+		"sibling": filepath.Join(base, "root2"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skip("symlink not supported:", err)
+		}
+	}
+
+	a := &Agent{fileRoots: []string{root + string(filepath.Separator)}}
+
+	tests := []struct {
+		name   string
+		path   string
+		create bool
+		// resolved path, empty if refused
+		want string
+	}{
+		{"file", filepath.Join(root, "a.txt"), false, filepath.Join(root, "a.txt")},
+		{"root itself", root, false, root},
+		{"sub dir", filepath.Join(root, "sub"), false, filepath.Join(root, "sub")},
+		{"dot dot inside", filepath.Join(root, "sub") + "/../a.txt", false, filepath.Join(root, "a.txt")},
+		{"dot dot escape", root + "/../secret", false, ""},
+		{"dot dot escape create", root + "/../new.txt", true, ""},
+		{"relative", "root/a.txt", false, ""},
+		{"sibling prefix", filepath.Join(base, "root2", "b.txt"), false, ""},
+		{"sibling prefix create", filepath.Join(base, "root2", "new.txt"), true, ""},
+		{"parent", base, false, ""},
+		{"symlink escape", filepath.Join(root, "out"), false, ""},
+		{"symlink dir escape", filepath.Join(root, "outdir", "secret"), false, ""},
+		{"symlink sibling escape", filepath.Join(root, "sibling", "b.txt"), false, ""},
+		{"symlink inside", filepath.Join(root, "in"), false, filepath.Join(root, "a.txt")},
+		{"missing", filepath.Join(root, "none"), false, ""},
+		{"create new", filepath.Join(root, "new.txt"), true, filepath.Join(root, "new.txt")},
+		{"create in sub", filepath.Join(root, "sub", "new.txt"), true, filepath.Join(root, "sub", "new.txt")},
+		{"create missing dir", filepath.Join(root, "nodir", "new.txt"), true, ""},
+		{"create through symlink dir", filepath.Join(root, "outdir", "new.txt"), true, ""},
+		{"create over symlink escape", filepath.Join(root, "out"), true, ""},
+		{"create over symlink inside", filepath.Join(root, "in"), true, filepath.Join(root, "a.txt")},
+		{"create over dangling symlink", filepath.Join(root, "dangle"), true, filepath.Join(root, "dangle")},
+	}
+
+	for _, tt := range tests {
+		got, err := a.filePath(tt.path, tt.create)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: filePath(%q, %v) = %q, want refused", tt.name, tt.path, tt.create, got)
+			}
+			continue
+		}
+
+		if err != nil || got != tt.want {
+			t.Errorf("%s: filePath(%q, %v) = %q, %v, want %q", tt.name, tt.path, tt.create, got, err, tt.want)
+		}
+	}
+}
+
+func TestFilePathNoRoots(t *testing.T) {
+	a := &Agent{}
+	if _, err := a.filePath(os.TempDir(), false); err == nil {
+		t.Error("filePath without roots should refuse")
+	}
+}
+
+func TestOpenPart(t *testing.T) {
+	base, err := ioutil.TempDir("", "lxport-part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	secret := filepath.Join(base, "secret")
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// partial file planted as symlink out of root
+	link := filepath.Join(base, "x.part")
+	if err := os.Symlink(secret, link); err != nil {
+		t.Skip("symlink not supported:", err)
+	}
+
+	if f, err := openPart(link); err == nil {
+		f.Close()
+		t.Error("openPart of symlink should refuse")
+	}
+
+	dangle := filepath.Join(base, "y.part")
+	if err := os.Symlink(filepath.Join(base, "none"), dangle); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := openPart(dangle); err == nil {
+		f.Close()
+		t.Error("openPart of dangling symlink should refuse")
+	}
+	if _, err := os.Stat(filepath.Join(base, "none")); err == nil {
+		t.Error("openPart should not create target of dangling symlink")
+	}
+
+	dir := filepath.Join(base, "d.part")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := openPart(dir); err == nil {
+		f.Close()
+		t.Error("openPart of directory should refuse")
+	}
+
+	if b, _ := ioutil.ReadFile(secret); string(b) != "secret" {
+		t.Errorf("target of symlink changed: %q", b)
+	}
+
+	// new and existing regular partial files
+	part := filepath.Join(base, "z.part")
+	for i := 0; i < 2; i++ {
+		f, err := openPart(part)
+		if err != nil {
+			t.Fatalf("openPart regular file failed:%v", err)
+		}
+		f.Write([]byte("a"))
+		f.Close()
+	}
+}
@@ -0,0 +1,239 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"lxport/wsconn"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// link request status of cmdLinkResponse
+const (
+	linkOK     = 0
+	linkDenied = 1
+)
+
+// how long to wait server to response link request
+const linkRequestTimeout = 10 * time.Second
+
+// link local port forward to port of another device
+type link struct {
+	// local listen port
+	localPort uint16
+	// target device uuid, or pool with "@" prefix
+	device string
+	// port of target device
+	remotePort uint16
+
+	listener net.Listener
+}
+
+// linkResponse server's response of link request
+type linkResponse struct {
+	status byte
+	token  string
+}
+
+// parseLink parse link "lport:device:rport", "@name" as device means pool
+func parseLink(s string) (*link, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid link %q, expect lport:device:rport", s)
+	}
+
+	lport, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid link %q, bad local port: %v", s, err)
+	}
+
+	rport, err := strconv.ParseUint(parts[2], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid link %q, bad remote port: %v", s, err)
+	}
+
+	return &link{
+		localPort:  uint16(lport),
+		device:     parts[1],
+		remotePort: uint16(rport),
+	}, nil
+}
+
+// startLinks listen on local port of all links
+func (a *Agent) startLinks() {
+	for _, l := range a.links {
+		// only listen on local host
+		address := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(l.localPort)))
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			log.Errorf("startLinks listen on %s failed:%v", address, err)
+			continue
+		}
+
+		l.listener = listener
+		log.Printf("startLinks %s link to %s:%d", address, l.device, l.remotePort)
+		go a.serveLink(l)
+	}
+}
+
+// closeLinks close listeners of all links
+func (a *Agent) closeLinks() {
+	for _, l := range a.links {
+		if l.listener != nil {
+			l.listener.Close()
+		}
+	}
+}
+
+// serveLink accept connections on link's listener
+func (a *Agent) serveLink(l *link) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			log.Printf("serveLink listener %s closed:%v", l.listener.Addr(), err)
+			return
+		}
+
+		go a.serveLinkConn(conn, l)
+	}
+}
+
+// serveLinkConn pair accepted connection to target device
+func (a *Agent) serveLinkConn(conn net.Conn, l *link) {
+	defer conn.Close()
+
+	if a.isDraining() {
+		return
+	}
+
+	atomic.AddInt32(&a.activeStreams, 1)
+	defer atomic.AddInt32(&a.activeStreams, -1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), linkRequestTimeout)
+	defer cancel()
+
+	stream, err := a.dialLink(ctx, l)
+	if err != nil {
+		log.Printf("serveLinkConn link to %s:%d failed:%v", l.device, l.remotePort, err)
+		return
+	}
+
+	defer stream.Close()
+
+	wsconn.Bridge(conn, stream)
+}
+
+// dialLink request link via command websocket, and connect
+// to server with the granted token
+func (a *Agent) dialLink(ctx context.Context, l *link) (net.Conn, error) {
+	token, err := a.requestLink(ctx, l)
+	if err != nil {
+		return nil, err
+	}
+
+	wsURLLink := fmt.Sprintf("%s?pt=link&uuid=%s&ready=1", a.wsURLBase, token)
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, wsURLLink, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// wait target device connected
+	err = wsconn.WaitReady(ctx, ws)
+	if err != nil {
+		return nil, err
+	}
+
+	// use websocket's local address as wsholder's identifier
+	wh := newHolder(ws.LocalAddr().String(), ws)
+	// save to map, for keep-alive
+	a.addHolder(wh)
+
+	// remove from map when stream closed
+	stream := wsconn.NewWithCloser(ws, func() {
+		a.removeHolder(wh)
+	})
+
+	return stream, nil
+}
+
+// requestLink send link request via command websocket, wait server's token,
+// packet: op(1) + request id(4) + port(2) + target device uuid
+func (a *Agent) requestLink(ctx context.Context, l *link) (string, error) {
+	reqID := atomic.AddUint32(&a.linkSeq, 1)
+	ch := make(chan *linkResponse, 1)
+
+	a.lock.Lock()
+	cmdws := a.wsholderMap[a.deviceID]
+	a.linkWaits[reqID] = ch
+	a.lock.Unlock()
+
+	defer func() {
+		a.lock.Lock()
+		delete(a.linkWaits, reqID)
+		a.lock.Unlock()
+	}()
+
+	if cmdws == nil {
+		return "", errors.New("not registered to server")
+	}
+
+	bs := make([]byte, 7+len(l.device))
+	bs[0] = devLinkRequest
+	binary.LittleEndian.PutUint32(bs[1:], reqID)
+	binary.LittleEndian.PutUint16(bs[5:], l.remotePort)
+	copy(bs[7:], []byte(l.device))
+
+	err := cmdws.write(websocket.BinaryMessage, bs)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case resp := <-ch:
+		switch resp.status {
+		case linkOK:
+			return resp.token, nil
+		case linkDenied:
+			return "", errors.New("link not allowed by server")
+		default:
+			return "", fmt.Errorf("link request failed, status:%d", resp.status)
+		}
+	}
+}
+
+// onLinkResponse server response link request,
+// packet: op(1) + request id(4) + status(1) + token
+func (a *Agent) onLinkResponse(message []byte) {
+	if len(message) < 6 {
+		log.Errorf("onLinkResponse invalid message length:%d", len(message))
+		return
+	}
+
+	reqID := binary.LittleEndian.Uint32(message[1:5])
+	resp := &linkResponse{
+		status: message[5],
+		token:  string(message[6:]),
+	}
+
+	a.lock.Lock()
+	ch := a.linkWaits[reqID]
+	a.lock.Unlock()
+
+	if ch == nil {
+		log.Println("onLinkResponse no request waiting, id:", reqID)
+		return
+	}
+
+	ch <- resp
+}
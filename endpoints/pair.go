@@ -0,0 +1,255 @@
+package endpoints
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"lxport/wsconn"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// pair kinds of cmdPairCreateExt
+const (
+	// pairKindTCP tcp stream to host:port
+	pairKindTCP = 0
+	// pairKindVPN ip packets, forward via tun interface
+	pairKindVPN = 1
+	// pairKindUDP udp datagrams framed with association id
+	pairKindUDP = 2
+	// pairKindShell terminal, spawn shell with pty
+	pairKindShell = 3
+	// pairKindExec non-interactive command, stream its output
+	pairKindExec = 4
+	// pairKindFile file transfer under root directories
+	pairKindFile = 5
+)
+
+// pairMeta extra information of cmdPairCreateExt
+type pairMeta struct {
+	// target host that device connect to, instead of localhost
+	Host string `json:"host,omitempty"`
+	// address of vpn interface, with prefix length
+	Addr string `json:"addr,omitempty"`
+	// endpoint-c address of vpn pair
+	Peer string `json:"peer,omitempty"`
+	// command and arguments of exec pair
+	Command []string `json:"command,omitempty"`
+	// timeout in seconds of exec pair
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// onPairRequest connect to server via websocket, and hand the pair
+// stream to port's handler; if no handler registered for the port,
+// connect to local port via tcp and bridge the two connections.
+func (a *Agent) onPairRequest(message []byte) {
+	// target port
+	port := binary.LittleEndian.Uint16(message[1:3])
+	// pair uuid
+	uuid := string(message[3:])
+
+	a.servePair(uuid, port, "")
+}
+
+// onPairRequestExt parse pair create request with kind and meta,
+// packet: op(1) + kind(1) + port(2) + meta length(2) + meta json + pair uuid
+func (a *Agent) onPairRequestExt(message []byte) {
+	if len(message) < 6 {
+		log.Errorf("onPairRequestExt invalid message length:%d", len(message))
+		return
+	}
+
+	kind := message[1]
+	port := binary.LittleEndian.Uint16(message[2:4])
+	metaLen := int(binary.LittleEndian.Uint16(message[4:6]))
+	if len(message) < 6+metaLen {
+		log.Errorf("onPairRequestExt invalid meta length:%d", metaLen)
+		return
+	}
+
+	meta := &pairMeta{}
+	err := json.Unmarshal(message[6:6+metaLen], meta)
+	if err != nil {
+		log.Errorf("onPairRequestExt invalid meta:%v", err)
+		return
+	}
+
+	uuid := string(message[6+metaLen:])
+
+	switch kind {
+	case pairKindTCP:
+		a.servePair(uuid, port, meta.Host)
+	case pairKindVPN:
+		a.serveVPN(uuid, meta)
+	case pairKindUDP:
+		a.serveUDP(uuid, port, meta.Host)
+	case pairKindShell:
+		a.serveShell(uuid)
+	case pairKindExec:
+		a.serveExec(uuid, meta)
+	case pairKindFile:
+		a.serveFile(uuid)
+	default:
+		log.Errorf("onPairRequestExt unsupport pair kind:%d", kind)
+	}
+}
+
+// servePair serve tcp stream pair to host:port, empty host means localhost
+func (a *Agent) servePair(uuid string, port uint16, host string) {
+	if a.isDraining() {
+		log.Println("onPairRequest ignore, endpoint is draining")
+		return
+	}
+
+	atomic.AddInt32(&a.activeStreams, 1)
+	defer atomic.AddInt32(&a.activeStreams, -1)
+
+	var handler Handler
+	// only allow connect to local host if host not provided
+	ip := net.IPv4(127, 0, 0, 1)
+	if host == "" {
+		handler = a.handler(port)
+	} else {
+		var ok bool
+		ip, ok = a.allowHost(host)
+		if !ok {
+			log.Errorf("onPairRequest host:%s not allowed", host)
+			return
+		}
+	}
+
+	// config restrict local ports, however local host is specified
+	if isLocalIP(ip) && !a.allowPort(port) {
+		log.Errorf("onPairRequest port:%d not allowed", port)
+		return
+	}
+
+	if handler == nil {
+		// dial the vetted address, resolve host again may get another one
+		address := net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+
+		// connect to local network via tcp, before response
+		// the pair, so that server can failover if refused
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			log.Errorf("onPairRequest connect to address:%s failed:%v", address, err)
+			return
+		}
+
+		handler = HandlerFunc(func(stream net.Conn) {
+			wsconn.Bridge(conn, stream)
+		})
+
+		// ensure the tcp connection will closed final
+		defer conn.Close()
+	}
+
+	stream, err := a.dialPairResponse(uuid)
+	if err != nil {
+		log.Println("onPairRequest failed connect to websocket server:", err)
+		return
+	}
+
+	// ensure the websocket will be closed final
+	defer stream.Close()
+
+	handler.ServeConn(stream)
+}
+
+// allowHost check if host in device's network is allowed to connect,
+// localhost is always allowed, host name is resolved and all of its
+// addresses must be allowed. Return the address that should be dialed
+func (a *Agent) allowHost(host string) (net.IP, bool) {
+	if host == "localhost" {
+		return net.IPv4(127, 0, 0, 1), true
+	}
+
+	var ips []net.IP
+	ip := net.ParseIP(host)
+	if ip != nil {
+		ips = append(ips, ip)
+	} else {
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			log.Errorf("allowHost lookup %s failed:%v", host, err)
+			return nil, false
+		}
+		ips = addrs
+	}
+
+	if len(ips) == 0 {
+		return nil, false
+	}
+
+	for _, ip := range ips {
+		if !ip.IsLoopback() && !a.allowIP(ip) {
+			return nil, false
+		}
+	}
+
+	return ips[0], true
+}
+
+// isLocalIP check if ip is of device itself, loopback, unspecified
+// or address of local interfaces
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// can not tell, treat as local to be safe
+		return true
+	}
+
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowIP check ip against allowed LAN networks
+func (a *Agent) allowIP(ip net.IP) bool {
+	a.lock.Lock()
+	allowLAN := a.allowLAN
+	a.lock.Unlock()
+
+	for _, n := range allowLAN {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dialPairResponse connect to server via websocket,
+// response that pair with uuid has created
+func (a *Agent) dialPairResponse(uuid string) (net.Conn, error) {
+	wsURLResp := fmt.Sprintf("%s?pt=resp&uuid=%s", a.wsURLBase, uuid)
+	ws, _, err := websocket.DefaultDialer.Dial(wsURLResp, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// use pair's uuid as wsholder's identifier
+	wh := newHolder(uuid, ws)
+	// save to map, for keep-alive
+	a.addHolder(wh)
+
+	// remove from map when stream closed
+	stream := wsconn.NewWithCloser(ws, func() {
+		a.removeHolder(wh)
+	})
+
+	return stream, nil
+}
@@ -0,0 +1,14 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package endpoints
+
+import (
+	"os"
+	"syscall"
+)
+
+// reexec replace current process with binary at path, same pid and arguments
+func reexec(path string) error {
+	return syscall.Exec(path, os.Args, os.Environ())
+}
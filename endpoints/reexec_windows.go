@@ -0,0 +1,22 @@
+package endpoints
+
+import (
+	"os"
+	"os/exec"
+)
+
+// reexec start binary at path with same arguments, then exit
+func reexec(path string) error {
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	os.Exit(0)
+	return nil
+}
@@ -0,0 +1,172 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"lxport/wsconn"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// onReverseListen listen on local port for endpoint-c, connections
+// accepted are paired back to endpoint-c via server,
+// packet: op(1) + port(2) + reverse id
+func (a *Agent) onReverseListen(message []byte) {
+	if len(message) < 4 {
+		log.Errorf("onReverseListen invalid message length:%d", len(message))
+		return
+	}
+
+	port := binary.LittleEndian.Uint16(message[1:3])
+	revID := string(message[3:])
+
+	if a.isDraining() {
+		log.Println("onReverseListen ignore, endpoint is draining")
+		a.sendReverseAck(revID, false)
+		return
+	}
+
+	// only listen on local host
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Errorf("onReverseListen listen on %s failed:%v", address, err)
+		a.sendReverseAck(revID, false)
+		return
+	}
+
+	a.lock.Lock()
+	old := a.reverses[revID]
+	a.reverses[revID] = l
+	a.lock.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	log.Printf("onReverseListen listen on %s, reverse id:%s", address, revID)
+	a.sendReverseAck(revID, true)
+	go a.serveReverse(l, revID)
+}
+
+// sendReverseAck tell server result of reverse listen,
+// packet: op(1) + status(1), 0 ok, 1 failed + reverse id
+func (a *Agent) sendReverseAck(revID string, ok bool) {
+	message := make([]byte, 2+len(revID))
+	message[0] = devReverseAck
+	if !ok {
+		message[1] = 1
+	}
+	copy(message[2:], revID)
+
+	a.lock.Lock()
+	cmdws := a.wsholderMap[a.deviceID]
+	a.lock.Unlock()
+
+	if cmdws != nil {
+		cmdws.write(websocket.BinaryMessage, message)
+	}
+}
+
+// onReverseClose close reverse listener,
+// packet: op(1) + port(2) + reverse id
+func (a *Agent) onReverseClose(message []byte) {
+	if len(message) < 4 {
+		log.Errorf("onReverseClose invalid message length:%d", len(message))
+		return
+	}
+
+	revID := string(message[3:])
+
+	a.lock.Lock()
+	l := a.reverses[revID]
+	delete(a.reverses, revID)
+	a.lock.Unlock()
+
+	if l != nil {
+		log.Printf("onReverseClose close %s, reverse id:%s", l.Addr(), revID)
+		l.Close()
+	}
+}
+
+// closeReverses close all reverse listeners, server forget
+// them when command websocket broken
+func (a *Agent) closeReverses() {
+	a.lock.Lock()
+	ls := a.reverses
+	a.reverses = make(map[string]net.Listener)
+	a.lock.Unlock()
+
+	for _, l := range ls {
+		l.Close()
+	}
+}
+
+// serveReverse accept connections on reverse listener
+func (a *Agent) serveReverse(l net.Listener, revID string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("serveReverse listener %s closed:%v", l.Addr(), err)
+			return
+		}
+
+		go a.serveReverseConn(conn, revID)
+	}
+}
+
+// serveReverseConn pair accepted connection to endpoint-c
+func (a *Agent) serveReverseConn(conn net.Conn, revID string) {
+	defer conn.Close()
+
+	atomic.AddInt32(&a.activeStreams, 1)
+	defer atomic.AddInt32(&a.activeStreams, -1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := a.dialReverseRequest(ctx, revID)
+	if err != nil {
+		log.Println("serveReverseConn pair to endpoint-c failed:", err)
+		return
+	}
+
+	defer stream.Close()
+
+	wsconn.Bridge(conn, stream)
+}
+
+// dialReverseRequest connect to server via websocket, request
+// pair to endpoint-c that own the reverse listener
+func (a *Agent) dialReverseRequest(ctx context.Context, revID string) (net.Conn, error) {
+	wsURLReq := fmt.Sprintf("%s?pt=rreq&uuid=%s&ready=1", a.wsURLBase, revID)
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, wsURLReq, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// wait endpoint-c connected
+	err = wsconn.WaitReady(ctx, ws)
+	if err != nil {
+		return nil, err
+	}
+
+	// use websocket's local address as wsholder's identifier
+	wh := newHolder(ws.LocalAddr().String(), ws)
+	// save to map, for keep-alive
+	a.addHolder(wh)
+
+	// remove from map when stream closed
+	stream := wsconn.NewWithCloser(ws, func() {
+		a.removeHolder(wh)
+	})
+
+	return stream, nil
+}
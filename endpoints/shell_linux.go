@@ -0,0 +1,123 @@
+package endpoints
+
+import (
+	"encoding/json"
+	"os/exec"
+	"sync/atomic"
+
+	"lxport/wsconn"
+
+	"github.com/creack/pty"
+	log "github.com/sirupsen/logrus"
+)
+
+// shell message ops, same as web ssh
+const (
+	shellOpData   = 0
+	shellOpPing   = 1
+	shellOpPong   = 2
+	shellOpResize = 3
+)
+
+// shellSize resize message
+type shellSize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// serveShell spawn shell with pty, and serve terminal messages of the pair:
+// op(1) + payload, op 0 data, 1 ping, 2 pong, 3 resize with json {rows, cols}
+func (a *Agent) serveShell(uuid string) {
+	if a.shell == "" {
+		log.Errorf("serveShell shell not enabled")
+		return
+	}
+
+	if a.isDraining() {
+		log.Println("serveShell ignore, endpoint is draining")
+		return
+	}
+
+	atomic.AddInt32(&a.activeStreams, 1)
+	defer atomic.AddInt32(&a.activeStreams, -1)
+
+	cmd := exec.Command(a.shell)
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		log.Errorf("serveShell pty start %s failed:%v", a.shell, err)
+		return
+	}
+
+	defer func() {
+		// ensure shell will exit final
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+		cmd.Wait()
+		ptmx.Close()
+	}()
+
+	conn, err := a.dialPairResponse(uuid)
+	if err != nil {
+		log.Println("serveShell failed connect to websocket server:", err)
+		return
+	}
+
+	stream := conn.(*wsconn.Conn)
+	defer stream.Close()
+
+	log.Printf("serveShell %s started, pid:%d", a.shell, cmd.Process.Pid)
+
+	// pty output to the pair
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := ptmx.Read(buf[1:])
+			if err != nil {
+				break
+			}
+
+			buf[0] = shellOpData
+			if _, err := stream.Write(buf[:n+1]); err != nil {
+				break
+			}
+		}
+
+		// shell exited
+		stream.Close()
+	}()
+
+	for {
+		message, err := stream.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		if len(message) < 1 {
+			continue
+		}
+
+		switch message[0] {
+		case shellOpData:
+			_, err = ptmx.Write(message[1:])
+			if err != nil {
+				log.Println("serveShell write to pty failed:", err)
+				return
+			}
+		case shellOpPing:
+			message[0] = shellOpPong
+			stream.Write(message)
+		case shellOpPong:
+		case shellOpResize:
+			sz := &shellSize{}
+			err = json.Unmarshal(message[1:], sz)
+			if err != nil {
+				log.Println("serveShell invalid resize:", err)
+				continue
+			}
+			pty.Setsize(ptmx, &pty.Winsize{Rows: sz.Rows, Cols: sz.Cols})
+		}
+	}
+
+	log.Printf("serveShell %s completed", a.shell)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package endpoints
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// serveShell shell not supported on this platform
+func (a *Agent) serveShell(uuid string) {
+	log.Println("shell not supported on this platform")
+}
@@ -0,0 +1,10 @@
+package endpoints
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// serveShell windows not support shell
+func (a *Agent) serveShell(uuid string) {
+	log.Println("windows not support shell")
+}
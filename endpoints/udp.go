@@ -0,0 +1,173 @@
+package endpoints
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lxport/wsconn"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// udp association idle timeout, socket is closed after it
+const udpIdleTimeout = 60 * time.Second
+
+// udpAssoc udp socket of an association, a source address of endpoint-c
+type udpAssoc struct {
+	conn net.Conn
+	// last active time in unix nano, access atomically
+	last int64
+}
+
+// serveUDP forward datagrams between the pair and udp host:port,
+// each message is: association id(4) + datagram, each association
+// has its own udp socket, closed when idle
+func (a *Agent) serveUDP(uuid string, port uint16, host string) {
+	if a.isDraining() {
+		log.Println("serveUDP ignore, endpoint is draining")
+		return
+	}
+
+	// only allow connect to local host if host not provided
+	ip := net.IPv4(127, 0, 0, 1)
+	if host != "" {
+		var ok bool
+		ip, ok = a.allowHost(host)
+		if !ok {
+			log.Errorf("serveUDP host:%s not allowed", host)
+			return
+		}
+	}
+
+	// config restrict local ports, however local host is specified
+	if isLocalIP(ip) && !a.allowPort(port) {
+		log.Errorf("serveUDP port:%d not allowed", port)
+		return
+	}
+
+	// send to the vetted address, resolve host again may get another one
+	raddr := &net.UDPAddr{IP: ip, Port: int(port)}
+
+	atomic.AddInt32(&a.activeStreams, 1)
+	defer atomic.AddInt32(&a.activeStreams, -1)
+
+	conn, err := a.dialPairResponse(uuid)
+	if err != nil {
+		log.Println("serveUDP failed connect to websocket server:", err)
+		return
+	}
+
+	stream := conn.(*wsconn.Conn)
+	defer stream.Close()
+
+	var lock sync.Mutex
+	assocs := make(map[uint32]*udpAssoc)
+	// remove association if it is still the one of id, and close it
+	removeAssoc := func(id uint32, as *udpAssoc) {
+		lock.Lock()
+		if assocs[id] == as {
+			delete(assocs, id)
+		}
+		lock.Unlock()
+		as.conn.Close()
+	}
+	defer func() {
+		lock.Lock()
+		for _, as := range assocs {
+			as.conn.Close()
+		}
+		lock.Unlock()
+	}()
+
+	// close idle associations
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(udpIdleTimeout / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			deadline := time.Now().Add(-udpIdleTimeout).UnixNano()
+			lock.Lock()
+			for id, as := range assocs {
+				if atomic.LoadInt64(&as.last) < deadline {
+					as.conn.Close()
+					delete(assocs, id)
+				}
+			}
+			lock.Unlock()
+		}
+	}()
+
+	log.Printf("serveUDP forward to %s", raddr)
+	for {
+		message, err := stream.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		if len(message) < 4 {
+			continue
+		}
+
+		id := binary.LittleEndian.Uint32(message[:4])
+
+		lock.Lock()
+		as := assocs[id]
+		if as == nil {
+			c, err := net.DialUDP("udp", nil, raddr)
+			if err != nil {
+				lock.Unlock()
+				log.Errorf("serveUDP dial %s failed:%v", raddr, err)
+				continue
+			}
+
+			// set before published, so that it is not idle to expiry
+			as = &udpAssoc{conn: c, last: time.Now().UnixNano()}
+			assocs[id] = as
+			go func(id uint32, as *udpAssoc) {
+				udpAssocReply(stream, id, as)
+				removeAssoc(id, as)
+			}(id, as)
+		}
+		lock.Unlock()
+
+		atomic.StoreInt64(&as.last, time.Now().UnixNano())
+		_, err = as.conn.Write(message[4:])
+		if err != nil {
+			// socket broken, next datagram will create a new one
+			removeAssoc(id, as)
+		}
+	}
+
+	log.Printf("serveUDP forward to %s end", raddr)
+}
+
+// udpAssocReply read reply datagrams of association, send them back to the
+// pair, return when association socket or pair broken
+func udpAssocReply(stream *wsconn.Conn, id uint32, as *udpAssoc) {
+	b := make([]byte, 65536)
+	binary.LittleEndian.PutUint32(b, id)
+
+	for {
+		n, err := as.conn.Read(b[4:])
+		if err != nil {
+			// closed when idle, or ICMP unreachable
+			return
+		}
+
+		atomic.StoreInt64(&as.last, time.Now().UnixNano())
+		if _, err := stream.Write(b[:4+n]); err != nil {
+			return
+		}
+	}
+}
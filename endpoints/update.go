@@ -0,0 +1,402 @@
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long to wait pair streams to end before re-exec
+const updateDrainTimeout = 30 * time.Second
+
+// updateAdvert update advertisement from server
+type updateAdvert struct {
+	Version string `json:"version"`
+	// json updateManifest, exactly the bytes that signed
+	Manifest string `json:"manifest"`
+	// base64 detached ed25519 signature of the manifest
+	Sig string `json:"sig"`
+}
+
+// updateManifest signed description of a build, binary is verified
+// by sha256 of it
+type updateManifest struct {
+	Version string `json:"version"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	Size    int64  `json:"size"`
+	// hex sha256 of the binary
+	SHA256 string `json:"sha256"`
+}
+
+// updateMarker written before re-exec to new binary, the new process
+// must register before deadline, otherwise old binary is restored
+type updateMarker struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Deadline int64  `json:"deadline"`
+}
+
+// executable path of running binary, symlinks resolved
+func executable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.EvalSymlinks(exe)
+}
+
+// onUpdate server advertise new build, packet: op(1) + json updateAdvert
+func (a *Agent) onUpdate(message []byte) {
+	adv := &updateAdvert{}
+	err := json.Unmarshal(message[1:], adv)
+	if err != nil {
+		log.Errorf("onUpdate invalid advertisement:%v", err)
+		return
+	}
+
+	if a.updateKey == nil {
+		log.Printf("onUpdate ignore version %s, no update key", adv.Version)
+		return
+	}
+
+	if adv.Version == a.version || a.isDraining() {
+		return
+	}
+
+	manifest, err := a.verifyManifest(adv)
+	if err != nil {
+		log.Errorf("onUpdate ignore version %s:%v", adv.Version, err)
+		return
+	}
+
+	if !newerVersion(manifest.Version, a.version) {
+		log.Printf("onUpdate ignore version %s, not newer than %s", manifest.Version, a.version)
+		return
+	}
+
+	if manifest.Version == a.failedVersion() {
+		log.Printf("onUpdate ignore version %s, rolled back before", manifest.Version)
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&a.updating, 0, 1) {
+		return
+	}
+
+	go func() {
+		err := a.update(manifest)
+		if err != nil {
+			log.Errorf("update to version %s failed:%v", manifest.Version, err)
+			atomic.StoreInt32(&a.updating, 0)
+		}
+	}()
+}
+
+// verifyManifest verify signature of manifest, and that it is of the
+// advertised version and build of this platform
+func (a *Agent) verifyManifest(adv *updateAdvert) (*updateManifest, error) {
+	sig, err := base64.StdEncoding.DecodeString(adv.Sig)
+	if err != nil || !ed25519.Verify(a.updateKey, []byte(adv.Manifest), sig) {
+		return nil, errors.New("signature verification failed")
+	}
+
+	manifest := &updateManifest{}
+	err = json.Unmarshal([]byte(adv.Manifest), manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Version != adv.Version {
+		return nil, fmt.Errorf("manifest is of version %s", manifest.Version)
+	}
+
+	if manifest.OS != runtime.GOOS || manifest.Arch != runtime.GOARCH {
+		return nil, fmt.Errorf("manifest is of %s-%s", manifest.OS, manifest.Arch)
+	}
+
+	if manifest.Size <= 0 || len(manifest.SHA256) != hex.EncodedLen(sha256.Size) {
+		return nil, errors.New("manifest without size or sha256")
+	}
+
+	return manifest, nil
+}
+
+// update download and verify new build, replace running binary, then
+// re-exec it. Old binary is restored and re-executed if that fails
+func (a *Agent) update(manifest *updateManifest) error {
+	log.Printf("update from version %s to %s, size:%d", a.version, manifest.Version, manifest.Size)
+
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+
+	data, err := a.downloadUpdate(manifest)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), manifest.SHA256) {
+		return errors.New("sha256 of binary does not match manifest")
+	}
+
+	st, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+
+	// write next to running binary, so that rename is atomic
+	newPath := exe + ".new"
+	err = writeFileSync(newPath, data, st.Mode())
+	if err != nil {
+		return err
+	}
+
+	oldPath := exe + ".old"
+	err = os.Rename(exe, oldPath)
+	if err != nil {
+		os.Remove(newPath)
+		return err
+	}
+
+	err = os.Rename(newPath, exe)
+	if err != nil {
+		os.Rename(oldPath, exe)
+		os.Remove(newPath)
+		return err
+	}
+
+	log.Printf("update binary replaced, draining, at most %s", updateDrainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), updateDrainTimeout)
+	a.Shutdown(ctx)
+	cancel()
+
+	marker := &updateMarker{
+		From:     a.version,
+		To:       manifest.Version,
+		Deadline: time.Now().Add(a.updateDeadline).Unix(),
+	}
+	b, _ := json.Marshal(marker)
+	err = writeFileSync(exe+".update", b, 0644)
+	if err == nil {
+		log.Printf("update re-exec %s, must register in %s", exe, a.updateDeadline)
+		err = reexec(exe)
+	}
+
+	// only return if re-exec failed, eg. binary of wrong format
+	a.rollback(exe, marker, err)
+	return err
+}
+
+// downloadUpdate download new build through server
+func (a *Agent) downloadUpdate(manifest *updateManifest) ([]byte, error) {
+	query := url.Values{}
+	query.Set("pt", "update")
+	query.Set("os", runtime.GOOS)
+	query.Set("arch", runtime.GOARCH)
+	query.Set("ver", manifest.Version)
+
+	ws, _, err := websocket.DefaultDialer.Dial(a.wsURLBase+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Close()
+
+	var buf bytes.Buffer
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil, err
+			}
+			break
+		}
+
+		if int64(buf.Len()+len(message)) > manifest.Size {
+			return nil, errors.New("download exceeds size of manifest")
+		}
+		buf.Write(message)
+	}
+
+	if int64(buf.Len()) != manifest.Size {
+		return nil, fmt.Errorf("download size %d, expect %d", buf.Len(), manifest.Size)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// checkUpdateMarker check if running binary is just updated, commit
+// when registered before deadline, otherwise roll back. Deadline has
+// passed if new binary crashed and restarted by service manager
+func (a *Agent) checkUpdateMarker() {
+	exe, err := executable()
+	if err != nil {
+		return
+	}
+
+	b, err := ioutil.ReadFile(exe + ".update")
+	if err != nil {
+		return
+	}
+
+	marker := &updateMarker{}
+	if json.Unmarshal(b, marker) != nil {
+		os.Remove(exe + ".update")
+		return
+	}
+
+	if marker.To != a.version {
+		// build is of other version than signed
+		a.rollback(exe, marker, fmt.Errorf("new binary is of version %s", a.version))
+		return
+	}
+
+	remain := time.Until(time.Unix(marker.Deadline, 0))
+	if remain <= 0 {
+		a.rollback(exe, marker, errors.New("not registered before deadline"))
+		return
+	}
+
+	a.lock.Lock()
+	a.updateExe = exe
+	a.lock.Unlock()
+
+	log.Printf("update from version %s to %s, must register in %s", marker.From, marker.To, remain)
+
+	time.AfterFunc(remain, func() {
+		a.lock.Lock()
+		pending := a.updateExe != ""
+		a.updateExe = ""
+		a.lock.Unlock()
+
+		if pending {
+			a.rollback(exe, marker, errors.New("not registered before deadline"))
+		}
+	})
+}
+
+// commitUpdate new binary registered, remove marker and old binary
+func (a *Agent) commitUpdate() {
+	a.lock.Lock()
+	exe := a.updateExe
+	a.updateExe = ""
+	a.lock.Unlock()
+
+	if exe == "" {
+		return
+	}
+
+	os.Remove(exe + ".update")
+	os.Remove(exe + ".old")
+	log.Println("update committed, version:", a.version)
+}
+
+// rollback restore old binary, and re-exec it
+func (a *Agent) rollback(exe string, marker *updateMarker, reason error) {
+	log.Warnf("update to version %s failed:%v, roll back to %s", marker.To, reason, marker.From)
+
+	os.Remove(exe + ".update")
+	// do not update to it again
+	writeFileSync(exe+".failed", []byte(marker.To), 0644)
+
+	err := os.Rename(exe+".old", exe)
+	if err != nil {
+		log.Errorf("update restore old binary failed:%v", err)
+		// still run old binary where it is
+		err = reexec(exe + ".old")
+	} else {
+		err = reexec(exe)
+	}
+
+	if err != nil {
+		log.Errorf("update re-exec old binary failed:%v", err)
+	}
+}
+
+// newerVersion check if version v is newer than cur, compare dot separated
+// fields, numerically if both are numbers, missing field is 0,
+// eg. 0.10.0 is newer than 0.9.1
+func newerVersion(v string, cur string) bool {
+	vs := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	cs := strings.Split(strings.TrimPrefix(cur, "v"), ".")
+
+	for i := 0; i < len(vs) || i < len(cs); i++ {
+		vf, cf := "0", "0"
+		if i < len(vs) {
+			vf = vs[i]
+		}
+		if i < len(cs) {
+			cf = cs[i]
+		}
+
+		vn, verr := strconv.ParseUint(vf, 10, 64)
+		cn, cerr := strconv.ParseUint(cf, 10, 64)
+		if verr == nil && cerr == nil {
+			if vn != cn {
+				return vn > cn
+			}
+			continue
+		}
+
+		if vf != cf {
+			return vf > cf
+		}
+	}
+
+	return false
+}
+
+// failedVersion version that rolled back before
+func (a *Agent) failedVersion() string {
+	exe, err := executable()
+	if err != nil {
+		return ""
+	}
+
+	b, err := ioutil.ReadFile(exe + ".failed")
+	if err != nil {
+		return ""
+	}
+
+	return string(b)
+}
+
+// writeFileSync write file and flush it to disk
+func writeFileSync(path string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,101 @@
+package endpoints
+
+import (
+	"net"
+	"sync/atomic"
+
+	"lxport/tun"
+	"lxport/wsconn"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serveVPN create tun interface with address in meta, and forward
+// ip packets between the pair and the interface. Packets to networks
+// other than the vpn network and allowed LAN networks are dropped
+func (a *Agent) serveVPN(uuid string, meta *pairMeta) {
+	if !a.vpn {
+		log.Errorf("serveVPN vpn not enabled")
+		return
+	}
+
+	if a.isDraining() {
+		log.Println("serveVPN ignore, endpoint is draining")
+		return
+	}
+
+	ip, vpnNet, err := net.ParseCIDR(meta.Addr)
+	if err != nil {
+		log.Errorf("serveVPN invalid address:%s", meta.Addr)
+		return
+	}
+
+	atomic.AddInt32(&a.activeStreams, 1)
+	defer atomic.AddInt32(&a.activeStreams, -1)
+
+	// create interface before response the pair,
+	// so that server can failover if failed
+	dev, err := tun.Open("lxvpn%d")
+	if err != nil {
+		log.Errorf("serveVPN create tun failed:%v", err)
+		return
+	}
+
+	defer dev.Close()
+
+	err = dev.Up(meta.Addr)
+	if err != nil {
+		log.Errorf("serveVPN setup tun failed:%v", err)
+		return
+	}
+
+	// route endpoint-c to LAN networks through device
+	a.lock.Lock()
+	lans := a.allowLAN
+	a.lock.Unlock()
+
+	if len(lans) > 0 {
+		cleanup, err := setupForward(dev.Name(), vpnNet, lans)
+		if err != nil {
+			log.Errorf("serveVPN forward to LAN networks failed, refuse vpn:%v", err)
+			return
+		}
+		defer cleanup()
+	}
+
+	stream, err := a.dialPairResponse(uuid)
+	if err != nil {
+		log.Println("serveVPN failed connect to websocket server:", err)
+		return
+	}
+
+	log.Printf("serveVPN %s(%s) up, peer:%s", dev.Name(), ip, meta.Peer)
+
+	allow := func(packet []byte) bool {
+		dst := packetDst(packet)
+		return dst != nil && (vpnNet.Contains(dst) || a.allowIP(dst))
+	}
+
+	wsconn.BridgePackets(stream.(*wsconn.Conn), dev, tun.MTU, allow)
+	log.Printf("serveVPN %s(%s) down", dev.Name(), ip)
+}
+
+// packetDst destination address of ip packet, nil if invalid
+func packetDst(packet []byte) net.IP {
+	if len(packet) < 1 {
+		return nil
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= 20 {
+			return net.IP(packet[16:20])
+		}
+	case 6:
+		if len(packet) >= 40 {
+			return net.IP(packet[24:40])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// setupForward forward packets from vpn network to LAN networks, with
+// masquerade so that LAN hosts reply to device. ip forwarding must be
+// enabled, eg. sysctl -w net.ipv4.ip_forward=1. Return func that
+// remove the rules
+func setupForward(dev string, vpnNet *net.IPNet, lans []*net.IPNet) (func(), error) {
+	b, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(string(b)) != "1" {
+		return nil, errors.New("ip forwarding disabled, run sysctl -w net.ipv4.ip_forward=1")
+	}
+
+	rules := [][]string{
+		{"FORWARD", "-i", dev, "-j", "ACCEPT"},
+		{"FORWARD", "-o", dev, "-j", "ACCEPT"},
+	}
+	for _, lan := range lans {
+		if lan.IP.To4() == nil {
+			continue
+		}
+		rules = append(rules, []string{"POSTROUTING", "-t", "nat", "-s", vpnNet.String(),
+			"-d", lan.String(), "-j", "MASQUERADE"})
+	}
+
+	var added [][]string
+	cleanup := func() {
+		for _, rule := range added {
+			if err := iptables("-D", rule); err != nil {
+				log.Warnf("setupForward remove rule failed:%v", err)
+			}
+		}
+	}
+
+	for _, rule := range rules {
+		if err := iptables("-I", rule); err != nil {
+			cleanup()
+			return nil, err
+		}
+		added = append(added, rule)
+	}
+
+	return cleanup, nil
+}
+
+// iptables add(-I) or delete(-D) rule, rule is chain followed by options
+func iptables(op string, rule []string) error {
+	args := append([]string{op}, rule...)
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s failed: %v, %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package endpoints
+
+import (
+	"net"
+
+	"lxport/tun"
+)
+
+// setupForward not supported on this platform
+func setupForward(dev string, vpnNet *net.IPNet, lans []*net.IPNet) (func(), error) {
+	return nil, tun.ErrNotSupported
+}
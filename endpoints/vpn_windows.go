@@ -0,0 +1,12 @@
+package endpoints
+
+import (
+	"net"
+
+	"lxport/tun"
+)
+
+// setupForward not supported on windows
+func setupForward(dev string, vpnNet *net.IPNet, lans []*net.IPNet) (func(), error) {
+	return nil, tun.ErrNotSupported
+}
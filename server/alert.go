@@ -0,0 +1,25 @@
+package server
+
+import (
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// conflictAlert build a conflict handler that run the alert command,
+// with device uuid, old and new remote address appended as arguments
+func conflictAlert(command string) func(uuid string, oldAddr string, newAddr string) {
+	return func(uuid string, oldAddr string, newAddr string) {
+		fields := strings.Fields(command)
+		args := append(fields[1:], uuid, oldAddr, newAddr)
+
+		// run in background, alert must not block device register
+		go func() {
+			out, err := exec.Command(fields[0], args...).CombinedOutput()
+			if err != nil {
+				log.Errorf("conflict alert command failed:%v, output:%s", err, out)
+			}
+		}()
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"lxport/server/tunpair"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// max devices that execute command concurrently of a request
+const execConcurrency = 32
+
+// max bytes kept of stdout/stderr of each device, for aggregated response
+const execOutputLimit = 1 << 20
+
+// execRequest exec api request body
+type execRequest struct {
+	// target device uuids
+	Devices []string `json:"devices"`
+	// command and arguments, not interpreted by shell
+	Command []string `json:"command"`
+	// timeout in seconds of each device
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// execDeviceResult result of a device, for aggregated response
+type execDeviceResult struct {
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	Code   int    `json:"code"`
+	Error  string `json:"error,omitempty"`
+}
+
+// execEvent one line of streaming response
+type execEvent struct {
+	Device string `json:"device"`
+	// stdout, stderr or exit
+	Stream string `json:"stream"`
+	Data   string `json:"data,omitempty"`
+	Code   int    `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// execHandler execute command on devices, POST json execRequest with
+// content type application/json, response json object of results index
+// by device; or if query stream=1, response json lines of execEvent as
+// output arrive
+func (s *Server) execHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.isDraining() {
+		http.Error(w, "server is going away", http.StatusServiceUnavailable)
+		return
+	}
+
+	// cross-site form can not send json without preflight
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mt != "application/json" {
+		http.Error(w, "need content type application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	req := &execRequest{}
+	err = json.NewDecoder(r.Body).Decode(req)
+	if err != nil || len(req.Devices) == 0 || len(req.Command) == 0 {
+		http.Error(w, "need devices and command", http.StatusBadRequest)
+		return
+	}
+
+	if s.params.ExecAuthorize != nil && !s.params.ExecAuthorize(r, req.Devices, req.Command) {
+		log.Printf("execHandler %v on %d devices not allowed, from:%s", req.Command, len(req.Devices), r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	log.Printf("execHandler %v on %d devices, from:%s", req.Command, len(req.Devices), r.RemoteAddr)
+
+	ctx := r.Context()
+	if req.Timeout > 0 {
+		// leave time for device to report timeout
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Second+10*time.Second)
+		defer cancel()
+	}
+
+	if r.URL.Query().Get("stream") == "1" {
+		s.execStream(ctx, w, req)
+		return
+	}
+
+	var lock sync.Mutex
+	results := make(map[string]*execDeviceResult)
+	for _, device := range req.Devices {
+		results[device] = &execDeviceResult{Code: -1}
+	}
+
+	s.execFanout(ctx, req, func(device string, stream int, data []byte) {
+		lock.Lock()
+		dr := results[device]
+		if stream == tunpair.ExecStdout {
+			dr.Stdout = appendLimit(dr.Stdout, data)
+		} else {
+			dr.Stderr = appendLimit(dr.Stderr, data)
+		}
+		lock.Unlock()
+	}, func(device string, result *tunpair.ExecResult, err error) {
+		lock.Lock()
+		dr := results[device]
+		if err != nil {
+			dr.Error = err.Error()
+		} else {
+			dr.Code = result.Code
+			dr.Error = result.Error
+		}
+		lock.Unlock()
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// appendLimit append data to s, truncated at execOutputLimit
+func appendLimit(s string, data []byte) string {
+	if len(s)+len(data) > execOutputLimit {
+		data = data[:execOutputLimit-len(s)]
+	}
+
+	return s + string(data)
+}
+
+// execStream execute command on devices, response json lines as output arrive
+func (s *Server) execStream(ctx context.Context, w http.ResponseWriter, req *execRequest) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+
+	var lock sync.Mutex
+	enc := json.NewEncoder(w)
+	emit := func(ev *execEvent) {
+		lock.Lock()
+		enc.Encode(ev)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		lock.Unlock()
+	}
+
+	s.execFanout(ctx, req, func(device string, stream int, data []byte) {
+		ev := &execEvent{Device: device, Stream: "stdout", Data: string(data)}
+		if stream == tunpair.ExecStderr {
+			ev.Stream = "stderr"
+		}
+		emit(ev)
+	}, func(device string, result *tunpair.ExecResult, err error) {
+		ev := &execEvent{Device: device, Stream: "exit", Code: -1}
+		if err != nil {
+			ev.Error = err.Error()
+		} else {
+			ev.Code = result.Code
+			ev.Error = result.Error
+		}
+		emit(ev)
+	})
+}
+
+// execFanout execute command on all devices concurrently, at most execConcurrency
+func (s *Server) execFanout(ctx context.Context, req *execRequest,
+	output func(device string, stream int, data []byte),
+	exit func(device string, result *tunpair.ExecResult, err error)) {
+	treq := &tunpair.ExecRequest{
+		Command: req.Command,
+		Timeout: req.Timeout,
+	}
+
+	sem := make(chan struct{}, execConcurrency)
+	var wg sync.WaitGroup
+	for _, device := range req.Devices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(device string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			result, err := s.relay.Exec(ctx, device, treq, func(stream int, data []byte) {
+				output(device, stream, data)
+			})
+			exit(device, result, err)
+		}(device)
+	}
+
+	wg.Wait()
+}
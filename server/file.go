@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"lxport/server/tunpair"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errOffsetBeyondSize requested offset beyond file size
+var errOffsetBeyondSize = errors.New("offset beyond file size")
+
+// fileHandler stream file from device, GET ?device=uuid&path=/abs/path,
+// optional offset=n to resume from
+func (s *Server) fileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.isDraining() {
+		http.Error(w, "server is going away", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	device := query.Get("device")
+	filePath := query.Get("path")
+	if device == "" || filePath == "" {
+		http.Error(w, "need device and path", http.StatusBadRequest)
+		return
+	}
+
+	var offset int64
+	if v := query.Get("offset"); v != "" {
+		var err error
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("fileHandler get %s of device %s, from:%s", filePath, device, r.RemoteAddr)
+
+	started := false
+	header := func(info *tunpair.FileInfo) error {
+		if info.Offset != offset {
+			return errOffsetBeyondSize
+		}
+
+		started = true
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size-offset, 10))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(filePath)))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	err := s.relay.ReadFile(r.Context(), device, filePath, offset, header, w)
+	if err == nil {
+		return
+	}
+
+	log.Printf("fileHandler get %s of device %s failed:%v", filePath, device, err)
+	if started {
+		// body is partial, client see it by content length
+		return
+	}
+
+	var fileErr *tunpair.FileError
+	switch {
+	case err == errOffsetBeyondSize:
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+	case errors.As(err, &fileErr):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err == tunpair.ErrDeviceNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
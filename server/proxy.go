@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"lxport/server/tunpair"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// port of device that subdomain without port proxies to
+const proxyDefaultPort = 80
+
+// proxyTarget device http service that request proxies to
+type proxyTarget struct {
+	device string
+	port   uint16
+	// path prefix that stripped from request, empty of subdomain
+	prefix string
+}
+
+type proxyTargetKey struct{}
+
+// proxyAllow device and port that proxy allowed to, * match any
+type proxyAllow struct {
+	device string
+	// 0 match any port
+	port uint16
+}
+
+// parseProxyAllow parse "device:port", eg. web1:80, *:8080, nas:*,
+// invalid ones are ignored
+func parseProxyAllow(rules []string) []*proxyAllow {
+	var result []*proxyAllow
+	for _, r := range rules {
+		device, portStr, err := net.SplitHostPort(strings.TrimSpace(r))
+		if err != nil || device == "" {
+			log.Warnf("invalid proxy allow:%s", r)
+			continue
+		}
+
+		var port uint64
+		if portStr != "*" {
+			port, err = strconv.ParseUint(portStr, 10, 16)
+			if err != nil || port == 0 {
+				log.Warnf("invalid proxy allow:%s", r)
+				continue
+			}
+		}
+
+		result = append(result, &proxyAllow{device: device, port: uint16(port)})
+	}
+
+	return result
+}
+
+// proxyAllowed check if request can be proxied to target, by
+// allow rules, then authorize hook
+func (s *Server) proxyAllowed(r *http.Request, target *proxyTarget) bool {
+	if len(s.proxyAllow) > 0 {
+		matched := false
+		for _, a := range s.proxyAllow {
+			if (a.device == "*" || a.device == target.device) &&
+				(a.port == 0 || a.port == target.port) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if s.params.ProxyAuthorize != nil {
+		return s.params.ProxyAuthorize(r, target.device, target.port)
+	}
+
+	return len(s.proxyAllow) > 0
+}
+
+// newProxy create reverse proxy to device http services, upstream
+// connections are pair streams to devices
+func (s *Server) newProxy() *httputil.ReverseProxy {
+	s.proxyTransport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			device, portStr, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			port, err := strconv.ParseUint(portStr, 10, 16)
+			if err != nil {
+				return nil, err
+			}
+
+			return s.relay.Dial(ctx, device, uint16(port))
+		},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     60 * time.Second,
+	}
+
+	return &httputil.ReverseProxy{
+		Director:       proxyDirector,
+		Transport:      s.proxyTransport,
+		ModifyResponse: proxyModifyResponse,
+		ErrorHandler:   proxyError,
+	}
+}
+
+// proxyHandler proxy request to device http service, by path
+// /d/<device>/<port>/... or subdomain <device>.domain, <port>.<device>.domain
+func (s *Server) proxyHandler(w http.ResponseWriter, r *http.Request) {
+	if s.isDraining() {
+		http.Error(w, "server is going away", http.StatusServiceUnavailable)
+		return
+	}
+
+	target, ok := s.proxyHostTarget(r.Host)
+	if !ok && s.proxyPath {
+		target, ok = s.proxyPathTarget(r.URL.Path)
+	}
+
+	if !ok {
+		http.Error(w, "need device and port", http.StatusNotFound)
+		return
+	}
+
+	if !s.proxyAllowed(r, target) {
+		log.Printf("proxyHandler %s:%d not allowed, from:%s", target.device, target.port, r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if target.prefix != "" && r.URL.Path == target.prefix {
+		// relative links of page need the trailing slash
+		http.Redirect(w, r, target.prefix+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	log.Debugf("proxyHandler %s %s to %s:%d", r.Method, r.URL.Path, target.device, target.port)
+	ctx := context.WithValue(r.Context(), proxyTargetKey{}, target)
+	s.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// proxyPathTarget parse /d/<device>/<port>/...
+func (s *Server) proxyPathTarget(path string) (*proxyTarget, bool) {
+	base := strings.TrimRight(s.params.ProxyPath, "/")
+	if base == "" || !strings.HasPrefix(path, base+"/") {
+		return nil, false
+	}
+
+	parts := strings.SplitN(path[len(base)+1:], "/", 3)
+	if len(parts) < 2 || parts[0] == "" {
+		return nil, false
+	}
+
+	port, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return nil, false
+	}
+
+	return &proxyTarget{
+		device: parts[0],
+		port:   uint16(port),
+		prefix: base + "/" + parts[0] + "/" + parts[1],
+	}, true
+}
+
+// proxyHostTarget parse <device>.domain or <port>.<device>.domain
+func (s *Server) proxyHostTarget(host string) (*proxyTarget, bool) {
+	domain := s.params.ProxyDomain
+	if domain == "" {
+		return nil, false
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(host)
+	domain = strings.ToLower(domain)
+	if !strings.HasSuffix(host, "."+domain) {
+		return nil, false
+	}
+
+	labels := strings.Split(strings.TrimSuffix(host, "."+domain), ".")
+	device := labels[len(labels)-1]
+	if device == "" {
+		return nil, false
+	}
+
+	switch len(labels) {
+	case 1:
+		return &proxyTarget{device: device, port: proxyDefaultPort}, true
+	case 2:
+		port, err := strconv.ParseUint(labels[0], 10, 16)
+		if err != nil {
+			return nil, false
+		}
+		return &proxyTarget{device: device, port: uint16(port)}, true
+	}
+
+	return nil, false
+}
+
+// isProxyHost check if request is of device subdomain
+func (s *Server) isProxyHost(host string) bool {
+	_, ok := s.proxyHostTarget(host)
+	return ok
+}
+
+// proxyDirector rewrite request to device http service
+func proxyDirector(r *http.Request) {
+	target := r.Context().Value(proxyTargetKey{}).(*proxyTarget)
+	port := strconv.Itoa(int(target.port))
+
+	r.Header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		r.Header.Set("X-Forwarded-Proto", "http")
+	}
+	if target.prefix != "" {
+		r.Header.Set("X-Forwarded-Prefix", target.prefix)
+	}
+
+	// host of url select the device connection, see DialContext
+	r.URL.Scheme = "http"
+	r.URL.Host = net.JoinHostPort(target.device, port)
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, target.prefix)
+	r.URL.RawPath = ""
+	if r.URL.Path == "" {
+		r.URL.Path = "/"
+	}
+
+	// service see itself is accessed locally
+	r.Host = "localhost:" + port
+}
+
+// proxyModifyResponse rewrite redirect location and cookie path of
+// device http service, so they stay under path prefix
+func proxyModifyResponse(resp *http.Response) error {
+	target := resp.Request.Context().Value(proxyTargetKey{}).(*proxyTarget)
+
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", proxyLocation(location, target, resp.Request.Header))
+	}
+
+	if target.prefix == "" {
+		return nil
+	}
+
+	cookies := resp.Header["Set-Cookie"]
+	for i, c := range cookies {
+		cookies[i] = proxyCookiePath(c, target.prefix)
+	}
+
+	return nil
+}
+
+// proxyLocation rewrite location that refer to device service itself
+func proxyLocation(location string, target *proxyTarget, header http.Header) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	if u.Host != "" {
+		host := u.Hostname()
+		if host != "localhost" && host != "127.0.0.1" {
+			// other site
+			return location
+		}
+
+		u.Scheme = header.Get("X-Forwarded-Proto")
+		u.Host = header.Get("X-Forwarded-Host")
+	}
+
+	if strings.HasPrefix(u.Path, "/") {
+		u.Path = target.prefix + u.Path
+		u.RawPath = ""
+	}
+
+	return u.String()
+}
+
+// proxyCookiePath put cookie path under prefix
+func proxyCookiePath(cookie string, prefix string) string {
+	parts := strings.Split(cookie, ";")
+	for i, p := range parts {
+		if i == 0 {
+			// name=value of cookie
+			continue
+		}
+
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "path") && strings.HasPrefix(kv[1], "/") {
+			parts[i] = " Path=" + prefix + kv[1]
+		}
+	}
+
+	return strings.Join(parts, ";")
+}
+
+// proxyError response error of proxy
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	target := r.Context().Value(proxyTargetKey{}).(*proxyTarget)
+	log.Printf("proxyHandler %s:%d failed:%v", target.device, target.port, err)
+
+	if errors.Is(err, tunpair.ErrDeviceNotFound) {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	http.Error(w, "device service unavailable", http.StatusBadGateway)
+}
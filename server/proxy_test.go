@@ -0,0 +1,208 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProxyPathTarget(t *testing.T) {
+	s := &Server{params: &Params{ProxyPath: "/d/"}}
+
+	tests := []struct {
+		path string
+		want *proxyTarget
+	}{
+		{"/d/dev1/80/", &proxyTarget{"dev1", 80, "/d/dev1/80"}},
+		{"/d/dev1/8080/a/b?c", &proxyTarget{"dev1", 8080, "/d/dev1/8080"}},
+		{"/d/dev1/80", &proxyTarget{"dev1", 80, "/d/dev1/80"}},
+		{"/d/dev1", nil},
+		{"/d/dev1/", nil},
+		{"/d//80/", nil},
+		{"/d/dev1/http/", nil},
+		{"/d/dev1/70000/", nil},
+		{"/d/dev1/-1/", nil},
+		{"/dx/dev1/80/", nil},
+		{"/d", nil},
+		{"/other/dev1/80/", nil},
+	}
+
+	for _, tt := range tests {
+		got, ok := s.proxyPathTarget(tt.path)
+		if tt.want == nil {
+			if ok {
+				t.Errorf("proxyPathTarget(%q) = %+v, want none", tt.path, *got)
+			}
+			continue
+		}
+
+		if !ok || *got != *tt.want {
+			t.Errorf("proxyPathTarget(%q) = %+v, %v, want %+v", tt.path, got, ok, *tt.want)
+		}
+	}
+
+	s.params.ProxyPath = ""
+	if _, ok := s.proxyPathTarget("/d/dev1/80/"); ok {
+		t.Error("proxyPathTarget should match nothing if disabled")
+	}
+}
+
+func TestProxyHostTarget(t *testing.T) {
+	s := &Server{params: &Params{ProxyDomain: "dev.example.com"}}
+
+	tests := []struct {
+		host string
+		want *proxyTarget
+	}{
+		{"web1.dev.example.com", &proxyTarget{"web1", 80, ""}},
+		{"web1.dev.example.com:8443", &proxyTarget{"web1", 80, ""}},
+		{"8080.web1.dev.example.com", &proxyTarget{"web1", 8080, ""}},
+		{"WEB1.Dev.Example.com", &proxyTarget{"web1", 80, ""}},
+		{"a.b.web1.dev.example.com", nil},
+		{"http.web1.dev.example.com", nil},
+		{"70000.web1.dev.example.com", nil},
+		{"dev.example.com", nil},
+		{".dev.example.com", nil},
+		{"webdev.example.com", nil},
+		{"web1.dev.example.com.evil.com", nil},
+		{"127.0.0.1:8010", nil},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		got, ok := s.proxyHostTarget(tt.host)
+		if tt.want == nil {
+			if ok {
+				t.Errorf("proxyHostTarget(%q) = %+v, want none", tt.host, *got)
+			}
+			continue
+		}
+
+		if !ok || *got != *tt.want {
+			t.Errorf("proxyHostTarget(%q) = %+v, %v, want %+v", tt.host, got, ok, *tt.want)
+		}
+	}
+}
+
+func TestProxyLocation(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Forwarded-Proto", "https")
+	header.Set("X-Forwarded-Host", "relay.example.com")
+
+	path := &proxyTarget{device: "dev1", port: 80, prefix: "/d/dev1/80"}
+	host := &proxyTarget{device: "dev1", port: 80}
+
+	tests := []struct {
+		location string
+		target   *proxyTarget
+		want     string
+	}{
+		{"/login", path, "/d/dev1/80/login"},
+		{"/a?b=1#c", path, "/d/dev1/80/a?b=1#c"},
+		{"/", path, "/d/dev1/80/"},
+		{"http://localhost:8080/x", path, "https://relay.example.com/d/dev1/80/x"},
+		{"http://127.0.0.1/x", path, "https://relay.example.com/d/dev1/80/x"},
+		{"https://other.example.com/x", path, "https://other.example.com/x"},
+		{"//other.example.com/x", path, "//other.example.com/x"},
+		{"http://localhost.evil.com/x", path, "http://localhost.evil.com/x"},
+		{"next", path, "next"},
+		{"/login", host, "/login"},
+		{"http://localhost/x", host, "https://relay.example.com/x"},
+	}
+
+	for _, tt := range tests {
+		if got := proxyLocation(tt.location, tt.target, header); got != tt.want {
+			t.Errorf("proxyLocation(%q, %q) = %q, want %q", tt.location, tt.target.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestProxyCookiePath(t *testing.T) {
+	prefix := "/d/dev1/80"
+
+	tests := []struct {
+		cookie string
+		want   string
+	}{
+		{"sid=1; Path=/; HttpOnly", "sid=1; Path=/d/dev1/80/; HttpOnly"},
+		{"sid=1; path=/app", "sid=1; Path=/d/dev1/80/app"},
+		{"sid=1;Path=/app;Secure", "sid=1; Path=/d/dev1/80/app;Secure"},
+		{"sid=1; HttpOnly", "sid=1; HttpOnly"},
+		{"sid=1; Path=app", "sid=1; Path=app"},
+		{"path=/x; Path=/", "path=/x; Path=/d/dev1/80/"},
+		{"sid=path=/x", "sid=path=/x"},
+		{"sid=1; Domain=example.com; Path=/", "sid=1; Domain=example.com; Path=/d/dev1/80/"},
+	}
+
+	for _, tt := range tests {
+		if got := proxyCookiePath(tt.cookie, prefix); got != tt.want {
+			t.Errorf("proxyCookiePath(%q) = %q, want %q", tt.cookie, got, tt.want)
+		}
+	}
+}
+
+func TestProxyAllowed(t *testing.T) {
+	s := &Server{
+		params: &Params{},
+		proxyAllow: parseProxyAllow([]string{
+			"web1:80",
+			"*:8080",
+			" nas:* ",
+			"bad",
+			"web2:http",
+			"web3:0",
+			":80",
+		}),
+	}
+
+	if len(s.proxyAllow) != 3 {
+		t.Fatalf("parseProxyAllow got %d rules, want 3", len(s.proxyAllow))
+	}
+
+	tests := []struct {
+		device string
+		port   uint16
+		allow  bool
+	}{
+		{"web1", 80, true},
+		{"web1", 443, false},
+		{"web2", 80, false},
+		{"web2", 8080, true},
+		{"nas", 5000, true},
+		{"nas2", 5000, false},
+		{"*", 80, false},
+	}
+
+	r := &http.Request{}
+	for _, tt := range tests {
+		target := &proxyTarget{device: tt.device, port: tt.port}
+		if got := s.proxyAllowed(r, target); got != tt.allow {
+			t.Errorf("proxyAllowed(%s:%d) = %v, want %v", tt.device, tt.port, got, tt.allow)
+		}
+	}
+
+	// authorize hook is checked after rules
+	s.params.ProxyAuthorize = func(r *http.Request, device string, port uint16) bool {
+		return port != 8080
+	}
+	if s.proxyAllowed(r, &proxyTarget{device: "web2", port: 8080}) {
+		t.Error("proxyAllowed should be refused by authorize hook")
+	}
+	if !s.proxyAllowed(r, &proxyTarget{device: "web1", port: 80}) {
+		t.Error("proxyAllowed should be allowed by rule and authorize hook")
+	}
+	if s.proxyAllowed(r, &proxyTarget{device: "web1", port: 443}) {
+		t.Error("proxyAllowed should be refused by rules before authorize hook")
+	}
+
+	// without rules, authorize hook decides
+	s.proxyAllow = nil
+	if !s.proxyAllowed(r, &proxyTarget{device: "any", port: 80}) {
+		t.Error("proxyAllowed should be allowed by authorize hook without rules")
+	}
+
+	// neither refuses all
+	s.params.ProxyAuthorize = nil
+	if s.proxyAllowed(r, &proxyTarget{device: "web1", port: 80}) {
+		t.Error("proxyAllowed without rules and authorize hook should refuse")
+	}
+}
@@ -1,10 +1,12 @@
 package server
 
 import (
+	"context"
 	"lxport/server/tunpair"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"encoding/binary"
@@ -13,15 +15,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"net/http"
-)
-
-var (
-	upgrader = websocket.Upgrader{
-		CheckOrigin: checkOrigin,
-	} // use default options
-
-	wsIndex = 0
-	wsmap   = make(map[int]*wsholder)
+	"net/http/httputil"
 )
 
 func checkOrigin(_ *http.Request) bool {
@@ -35,11 +29,10 @@ type wsholder struct {
 	waitping  int
 }
 
-func newHolder(c *websocket.Conn) *wsholder {
-	wsIndex++
+func newHolder(id int, c *websocket.Conn) *wsholder {
 	wsh := &wsholder{
 		conn: c,
-		id:   wsIndex,
+		id:   id,
 	}
 
 	// ping handle
@@ -93,8 +86,13 @@ func (wsh *wsholder) onPong(msg []byte) {
 }
 
 // xportWSHandler handle xport websocket
-func xportWSHandler(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+func (s *Server) xportWSHandler(w http.ResponseWriter, r *http.Request) {
+	if s.isDraining() {
+		http.Error(w, "server is going away", http.StatusServiceUnavailable)
+		return
+	}
+
+	c, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
@@ -120,15 +118,14 @@ func xportWSHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	wsh := newHolder(c)
 	// save to map for keep-alive
-	wsmap[wsh.id] = wsh
+	wsh := s.addHolder(c)
 
 	defer func() {
 		// ensoure tcp closed final
 		tcp.Close()
 		// delete from map
-		delete(wsmap, wsh.id)
+		s.removeHolder(wsh)
 	}()
 
 	// recv tcp message, and forward to websocket
@@ -206,18 +203,51 @@ func writeAll(buf []byte, nc net.Conn) error {
 	return nil
 }
 
+// addHolder create websocket holder and save to map for keep-alive
+func (s *Server) addHolder(c *websocket.Conn) *wsholder {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+
+	s.wsIndex++
+	wsh := newHolder(s.wsIndex, c)
+	s.wsmap[wsh.id] = wsh
+
+	return wsh
+}
+
+// removeHolder delete websocket holder from map
+func (s *Server) removeHolder(wsh *wsholder) {
+	s.wsLock.Lock()
+	delete(s.wsmap, wsh.id)
+	s.wsLock.Unlock()
+}
+
 // keepalive send ping to all websocket
-func keepalive() {
+func (s *Server) keepalive() {
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
+
 	for {
-		time.Sleep(time.Second * 30)
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
 
 		// first keepalive all xport/web-ssh websocket
-		for _, v := range wsmap {
+		s.wsLock.Lock()
+		whs := make([]*wsholder, 0, len(s.wsmap))
+		for _, v := range s.wsmap {
+			whs = append(whs, v)
+		}
+		s.wsLock.Unlock()
+
+		for _, v := range whs {
 			v.keepalive()
 		}
 
 		// then keepalive pair websocket
-		tunpair.Keepalive()
+		s.relay.Keepalive()
 	}
 }
 
@@ -233,26 +263,168 @@ type Params struct {
 	WebDir string
 	// pair http path
 	PairPath string
+	// how long a pair request waits for an offline device to come back
+	DeviceWaitTimeout time.Duration
+	// duplicate device registration policy: replace, reject or pool
+	DupPolicy string
+	// command to run when duplicate device registration occurs
+	ConflictAlert string
+	// device select strategy of pool: rr, least or rtt
+	PoolStrategy string
+	// how long to wait device to response pair create request
+	PairSetupTimeout time.Duration
+	// allow endpoint client to request reverse forwarding
+	AllowReverse bool
+	// rules "from:to" that device can link to another device
+	LinkRules []string
+	// ipv4 subnet that vpn addresses allocated from, empty disables vpn
+	VPNSubnet string
+	// client networks that allowed to start vpn pair
+	VPNClients []string
+	// allow web terminal to open shell on devices
+	RemoteShell bool
+	// path of exec api, empty disables it
+	ExecPath string
+	// optional, check if request can execute command on devices,
+	// called before dispatch
+	ExecAuthorize func(r *http.Request, devices []string, command []string) bool
+	// path of file download api, empty disables it
+	FilePath string
+	// path prefix that proxies to device http services,
+	// /prefix/<device>/<port>/..., empty disables it
+	ProxyPath string
+	// domain that its subdomains proxy to device http services,
+	// <device>.domain or <port>.<device>.domain, empty disables it
+	ProxyDomain string
+	// "device:port" that proxy allowed to, * match any device or port
+	ProxyAllow []string
+	// optional, check if request can be proxied to device and port,
+	// called after ProxyAllow matched; with neither all are refused
+	ProxyAuthorize func(r *http.Request, device string, port uint16) bool
+	// directory of endpoint server builds that devices update to
+	UpdateDir string
+	// directory of device config documents
+	ConfigDir string
+	// routes "name=device:port" of tls connections accepted by ServeSNI,
+	// *.domain=*:port routes each subdomain to device of its name
+	SNIRoutes []string
 }
 
-// CreateHTTPServer start http server
-func CreateHTTPServer(params *Params) {
-	// start keepalive goroutine
-	go keepalive()
+// Server lxport server, an http.Handler that can be mounted
+// to other mux, or started by itself with Start
+type Server struct {
+	params *Params
+
+	upgrader websocket.Upgrader
+	mux      *http.ServeMux
+	relay    *tunpair.Relay
+
+	// proxy to device http services, nil if disabled
+	proxy          *httputil.ReverseProxy
+	proxyTransport *http.Transport
+	proxyAllow     []*proxyAllow
+	// proxy by path prefix, refused if apis share the origin
+	proxyPath bool
+
+	// tls server name routes, and listeners of ServeSNI
+	sniRoutes    []*sniRoute
+	sniLock      sync.Mutex
+	sniListeners []net.Listener
+
+	// xport/web-ssh websocket, for keep-alive
+	wsLock  sync.Mutex
+	wsIndex int
+	wsmap   map[int]*wsholder
+
+	// used by Start
+	httpServer *http.Server
+	// closed to stop keepalive goroutine
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// set when shutting down, access atomically
+	draining int32
+}
+
+// New create server, and register all handlers with paths in params
+func New(params *Params) *Server {
+	s := &Server{
+		params: params,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: checkOrigin,
+		}, // use default options
+		mux:   http.NewServeMux(),
+		wsmap: make(map[int]*wsholder),
+		stop:  make(chan struct{}),
+
+		sniRoutes:  parseSNIRoutes(params.SNIRoutes),
+		proxyAllow: parseProxyAllow(params.ProxyAllow),
+	}
+
+	tpParams := &tunpair.Params{
+		DeviceWaitTimeout: params.DeviceWaitTimeout,
+		DupPolicy:         tunpair.DupPolicy(params.DupPolicy),
+		Strategy:          tunpair.Strategy(params.PoolStrategy),
+		PairSetupTimeout:  params.PairSetupTimeout,
+		AllowReverse:      params.AllowReverse,
+		LinkRules:         params.LinkRules,
+		VPNSubnet:         params.VPNSubnet,
+		VPNClients:        params.VPNClients,
+		UpdateDir:         params.UpdateDir,
+		ConfigDir:         params.ConfigDir,
+	}
+	if strings.TrimSpace(params.ConflictAlert) != "" {
+		tpParams.OnConflict = conflictAlert(params.ConflictAlert)
+	}
+	s.relay = tunpair.NewRelay(tpParams)
+	s.httpServer = &http.Server{
+		Addr:    params.ListenAddr,
+		Handler: s,
+	}
 
 	// xport
-	http.HandleFunc(params.XPortPath, xportWSHandler)
+	s.mux.HandleFunc(params.XPortPath, s.xportWSHandler)
 	// pair
-	http.HandleFunc(params.PairPath, tunpair.PairWSHandler)
+	s.mux.Handle(params.PairPath, s.relay)
+
+	// exec api
+	if params.ExecPath != "" {
+		s.mux.HandleFunc(params.ExecPath, s.execHandler)
+	}
+
+	// file download api
+	if params.FilePath != "" {
+		s.mux.HandleFunc(params.FilePath, s.fileHandler)
+	}
+
+	// proxy to device http services
+	if params.ProxyPath != "" || params.ProxyDomain != "" {
+		s.proxy = s.newProxy()
+		if len(s.proxyAllow) == 0 && params.ProxyAuthorize == nil {
+			log.Warn("proxy without allowed devices, all requests are refused")
+		}
+	}
+	if params.ProxyPath != "" {
+		// device pages would run in origin of exec, file, shell apis and
+		// web terminal
+		webSSH := params.WebDir != "" && params.WebPath != ""
+		if params.ExecPath != "" || params.FilePath != "" || params.RemoteShell || webSSH {
+			log.Error("proxy path disabled, it can not share host with exec, file, shell api or web ssh, use proxy domain instead")
+		} else {
+			s.proxyPath = true
+			s.mux.HandleFunc(strings.TrimRight(params.ProxyPath, "/")+"/", s.proxyHandler)
+		}
+	}
 
 	// web ssh
 	if params.WebDir != "" && params.WebPath != "" {
 		directory := params.WebDir // "/home/abc/webpack-starter/build"
-		http.Handle("/", http.StripPrefix(strings.TrimRight(params.WebPath, "/"),
+		webPath := strings.TrimRight(params.WebPath, "/")
+		s.mux.Handle(webPath+"/", http.StripPrefix(webPath,
 			http.FileServer(http.Dir(directory))))
 
-		websocketPath := strings.TrimRight(params.WebPath, "/") + "/ws"
-		http.HandleFunc(websocketPath, webSSHHandler)
+		websocketPath := webPath + "/ws"
+		s.mux.HandleFunc(websocketPath, s.terminalHandler)
 
 		log.Printf("start with webssh support, websoket:%s, web path:%s, web dir:%s",
 			websocketPath, params.WebPath, params.WebDir)
@@ -260,7 +432,114 @@ func CreateHTTPServer(params *Params) {
 		log.Warn("start without webssh support")
 	}
 
-	log.Printf("server listen at:%s, xportPath:%s, pair path:%s", params.ListenAddr,
-		params.XPortPath, params.PairPath)
-	log.Fatal(http.ListenAndServe(params.ListenAddr, nil))
+	// start keepalive goroutine
+	go s.keepalive()
+
+	return s
+}
+
+// ServeHTTP dispatch request to xport, pair or web-ssh handlers
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// device subdomain, all paths proxy to device
+	if s.proxy != nil && s.isProxyHost(r.Host) {
+		s.proxyHandler(w, r)
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// Start listen at params.ListenAddr and serve, block until server stopped
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.params.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve serve on listener, block until server stopped
+func (s *Server) Serve(l net.Listener) error {
+	log.Printf("server listen at:%s, xportPath:%s, pair path:%s", l.Addr(),
+		s.params.XPortPath, s.params.PairPath)
+
+	err := s.httpServer.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// Shutdown stop accepting new sessions and pairs, tell devices to
+// reconnect elsewhere, and wait existing ones to end. When ctx is done,
+// all remaining sessions and pairs are closed
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.draining, 1)
+	s.relay.Drain()
+
+	// stop accepting tls connections, existing ones are pairs
+	s.sniLock.Lock()
+	for _, l := range s.sniListeners {
+		l.Close()
+	}
+	s.sniLock.Unlock()
+
+	// idle proxy connections hold pairs
+	if s.proxyTransport != nil {
+		s.proxyTransport.CloseIdleConnections()
+	}
+
+	// stop listener if it is started by Start,
+	// hijacked websocket connections are not affected
+	err := s.httpServer.Shutdown(ctx)
+
+	// final, close whatever left and stop keepalive
+	defer func() {
+		s.closeAll()
+		s.stopOnce.Do(func() {
+			close(s.stop)
+		})
+	}()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for n := s.activeSessions(); n > 0; n = s.activeSessions() {
+		select {
+		case <-ctx.Done():
+			log.Warnf("server drain deadline, close %d sessions", n)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	log.Println("server shutdown completed")
+	return err
+}
+
+// isDraining return true if Shutdown has been called
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+// activeSessions count of xport/web-ssh websocket and pairs
+func (s *Server) activeSessions() int {
+	s.wsLock.Lock()
+	n := len(s.wsmap)
+	s.wsLock.Unlock()
+
+	return n + s.relay.ActivePairs()
+}
+
+// closeAll close all xport/web-ssh websocket, devices and pairs
+func (s *Server) closeAll() {
+	s.wsLock.Lock()
+	for _, v := range s.wsmap {
+		v.conn.Close()
+	}
+	s.wsLock.Unlock()
+
+	s.relay.Close()
 }
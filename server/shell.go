@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// terminalHandler handle terminal websocket(from web-browser) connection,
+// shell runs on the device if device is provided in query,
+// otherwise on server itself
+func (s *Server) terminalHandler(w http.ResponseWriter, r *http.Request) {
+	device := r.URL.Query().Get("device")
+	if device == "" {
+		s.webSSHHandler(w, r)
+		return
+	}
+
+	if !s.params.RemoteShell {
+		http.Error(w, "remote shell not allowed", http.StatusForbidden)
+		return
+	}
+
+	if s.isDraining() {
+		http.Error(w, "server is going away", http.StatusServiceUnavailable)
+		return
+	}
+
+	c, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return
+	}
+	// ensure websocket will be closed final
+	defer c.Close()
+
+	log.Printf("terminalHandler remote shell on device:%s, from:%s", device, c.RemoteAddr())
+	s.relay.ServeShell(c, device)
+	log.Println("terminalHandler remote shell completed, device:", device)
+}
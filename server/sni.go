@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"lxport/wsconn"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how long to wait client hello of tls connection
+const sniHelloTimeout = 10 * time.Second
+
+// errSNIPeeked abort handshake after server name peeked
+var errSNIPeeked = errors.New("server name peeked")
+
+// sniRoute route tls connection of server name to port of device
+type sniRoute struct {
+	// exact server name, or *.domain that match one label
+	pattern string
+	// device uuid, * means the label matched by pattern
+	device string
+	port   uint16
+}
+
+// parseSNIRoutes parse routes "name=device:port", eg. db1.example.com=db1:5432,
+// *.devices.example.com=*:443, invalid ones are ignored
+func parseSNIRoutes(routes []string) []*sniRoute {
+	var result []*sniRoute
+	for _, r := range routes {
+		kv := strings.SplitN(strings.TrimSpace(r), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			log.Warnf("invalid sni route:%s", r)
+			continue
+		}
+
+		device, portStr, err := net.SplitHostPort(kv[1])
+		if err != nil || device == "" {
+			log.Warnf("invalid sni route:%s", r)
+			continue
+		}
+
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			log.Warnf("invalid sni route:%s", r)
+			continue
+		}
+
+		if device == "*" && !strings.HasPrefix(kv[0], "*.") {
+			log.Warnf("invalid sni route:%s, * device need *.domain", r)
+			continue
+		}
+
+		result = append(result, &sniRoute{
+			pattern: strings.ToLower(kv[0]),
+			device:  device,
+			port:    uint16(port),
+		})
+	}
+
+	return result
+}
+
+// sniTarget find device and port of server name, exact name take
+// precedence over wildcard
+func (s *Server) sniTarget(name string) (string, uint16, bool) {
+	name = strings.ToLower(name)
+	for _, r := range s.sniRoutes {
+		if r.pattern == name {
+			return r.device, r.port, true
+		}
+	}
+
+	for _, r := range s.sniRoutes {
+		if !strings.HasPrefix(r.pattern, "*.") {
+			continue
+		}
+
+		suffix := r.pattern[1:]
+		label := strings.TrimSuffix(name, suffix)
+		if !strings.HasSuffix(name, suffix) || label == "" || strings.Contains(label, ".") {
+			continue
+		}
+
+		device := r.device
+		if device == "*" {
+			device = label
+		}
+		return device, r.port, true
+	}
+
+	return "", 0, false
+}
+
+// ServeSNI accept raw tls connections on listener, route each to
+// device by server name of client hello, and pipe it through a pair
+// without terminating tls. Block until listener closed
+func (s *Server) ServeSNI(l net.Listener) error {
+	s.sniLock.Lock()
+	s.sniListeners = append(s.sniListeners, l)
+	s.sniLock.Unlock()
+
+	log.Printf("sni listen at:%s, routes:%d", l.Addr(), len(s.sniRoutes))
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isDraining() {
+				return nil
+			}
+
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		go s.serveSNIConn(conn)
+	}
+}
+
+// serveSNIConn peek server name, then bridge connection with pair
+func (s *Server) serveSNIConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(sniHelloTimeout))
+	name, hello, err := peekServerName(conn)
+	if err != nil {
+		log.Printf("serveSNIConn from %s, peek server name failed:%v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	device, port, ok := s.sniTarget(name)
+	if !ok {
+		log.Printf("serveSNIConn from %s, no route for %s", conn.RemoteAddr(), name)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sniHelloTimeout)
+	stream, err := s.relay.Dial(ctx, device, port)
+	cancel()
+	if err != nil {
+		log.Printf("serveSNIConn %s to %s:%d failed:%v", name, device, port, err)
+		return
+	}
+
+	log.Printf("serveSNIConn %s from %s to %s:%d", name, conn.RemoteAddr(), device, port)
+
+	// client hello has been read, replay it to device
+	_, err = stream.Write(hello)
+	if err != nil {
+		stream.Close()
+		return
+	}
+
+	wsconn.Bridge(conn, stream)
+}
+
+// peekServerName read client hello, return server name and bytes read
+func peekServerName(r io.Reader) (string, []byte, error) {
+	var buf bytes.Buffer
+	var name string
+
+	config := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errSNIPeeked
+		},
+	}
+
+	err := tls.Server(readOnlyConn{r: io.TeeReader(r, &buf)}, config).Handshake()
+	if name == "" {
+		if err == nil || errors.Is(err, errSNIPeeked) {
+			err = errors.New("no server name")
+		}
+		return "", nil, err
+	}
+
+	return name, buf.Bytes(), nil
+}
+
+// readOnlyConn net.Conn that only read, for peeking client hello
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
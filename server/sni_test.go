@@ -0,0 +1,73 @@
+package server
+
+import "testing"
+
+func TestParseSNIRoutes(t *testing.T) {
+	routes := parseSNIRoutes([]string{
+		"db1.example.com=db1:5432",
+		" *.devices.example.com=*:443 ",
+		"DB2.Example.com=db2:5432",
+		"noport.example.com=db1",
+		"badport.example.com=db1:99999",
+		"=db1:80",
+		"nodevice.example.com=:80",
+		"wild.example.com=*:443",
+		"garbage",
+	})
+
+	want := []sniRoute{
+		{"db1.example.com", "db1", 5432},
+		{"*.devices.example.com", "*", 443},
+		{"db2.example.com", "db2", 5432},
+	}
+
+	if len(routes) != len(want) {
+		t.Fatalf("parseSNIRoutes got %d routes, want %d", len(routes), len(want))
+	}
+
+	for i, r := range routes {
+		if *r != want[i] {
+			t.Errorf("route %d = %+v, want %+v", i, *r, want[i])
+		}
+	}
+}
+
+func TestSNITarget(t *testing.T) {
+	s := &Server{
+		sniRoutes: parseSNIRoutes([]string{
+			"*.devices.example.com=*:443",
+			"db.devices.example.com=db1:5432",
+			"*.db.example.com=dbpool:5432",
+			"MAIL.example.com=mail:993",
+		}),
+	}
+
+	tests := []struct {
+		name   string
+		device string
+		port   uint16
+		ok     bool
+	}{
+		{"web1.devices.example.com", "web1", 443, true},
+		{"WEB1.Devices.Example.com", "web1", 443, true},
+		{"db.devices.example.com", "db1", 5432, true},
+		{"a.db.example.com", "dbpool", 5432, true},
+		{"mail.example.com", "mail", 993, true},
+		{"a.b.devices.example.com", "", 0, false},
+		{"devices.example.com", "", 0, false},
+		{".devices.example.com", "", 0, false},
+		{"evildevices.example.com", "", 0, false},
+		{"web1.devices.example.com.evil.com", "", 0, false},
+		{"db.example.com", "", 0, false},
+		{"x.mail.example.com", "", 0, false},
+		{"", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		device, port, ok := s.sniTarget(tt.name)
+		if device != tt.device || port != tt.port || ok != tt.ok {
+			t.Errorf("sniTarget(%q) = %q, %d, %v, want %q, %d, %v",
+				tt.name, device, port, ok, tt.device, tt.port, tt.ok)
+		}
+	}
+}
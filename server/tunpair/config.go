@@ -0,0 +1,163 @@
+package tunpair
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// configHeader version of device config document, other fields
+// are interpreted by device
+type configHeader struct {
+	Version int64 `json:"version"`
+}
+
+// configAck device acknowledge config document
+type configAck struct {
+	Version int64  `json:"version"`
+	Error   string `json:"error,omitempty"`
+}
+
+// configFile config document in config dir
+type configFile struct {
+	modTime time.Time
+	size    int64
+	doc     []byte
+	version int64
+}
+
+// scanConfigs reload config documents that changed since last scan,
+// by modification time and size. Return true if any added, changed
+// or removed
+func (relay *Relay) scanConfigs() bool {
+	if relay.configDir == "" {
+		return false
+	}
+
+	infos, err := ioutil.ReadDir(relay.configDir)
+	if err != nil {
+		log.Warnf("scanConfigs read config dir failed:%v", err)
+		return false
+	}
+
+	relay.configLock.Lock()
+	old := relay.configFiles
+	relay.configLock.Unlock()
+
+	changed := false
+	files := make(map[string]*configFile)
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		f, ok := old[name]
+		if ok && f.modTime.Equal(fi.ModTime()) && f.size == fi.Size() {
+			files[name] = f
+			continue
+		}
+
+		changed = true
+		b, err := ioutil.ReadFile(filepath.Join(relay.configDir, name))
+		if err != nil {
+			continue
+		}
+
+		header := &configHeader{}
+		err = json.Unmarshal(b, header)
+		if err != nil {
+			log.Warnf("scanConfigs invalid config %s:%v", name, err)
+			continue
+		}
+
+		files[name] = &configFile{
+			modTime: fi.ModTime(),
+			size:    fi.Size(),
+			doc:     b,
+			version: header.Version,
+		}
+	}
+
+	if len(files) != len(old) {
+		changed = true
+	}
+
+	relay.configLock.Lock()
+	relay.configFiles = files
+	relay.configLock.Unlock()
+
+	return changed
+}
+
+// loadConfig config document of device, <uuid>.json in config dir,
+// or default.json if not exist. nil if no config
+func (relay *Relay) loadConfig(uuid string) ([]byte, int64) {
+	relay.configLock.Lock()
+	defer relay.configLock.Unlock()
+
+	for _, name := range []string{uuid + ".json", "default.json"} {
+		if f, ok := relay.configFiles[name]; ok {
+			return f.doc, f.version
+		}
+	}
+
+	return nil, 0
+}
+
+// pushConfig send config document to device if its version differ from
+// device's, packet: op(1) + json document
+func (relay *Relay) pushConfig(d *Device) {
+	doc, version := relay.loadConfig(d.uuid)
+	if doc == nil {
+		return
+	}
+
+	d.configLock.Lock()
+	if version == d.configVersion || version == d.configPushed {
+		d.configLock.Unlock()
+		return
+	}
+	d.configPushed = version
+	d.configLock.Unlock()
+
+	log.Printf("pushConfig device %s config version %d", d.uuid, version)
+	d.write(websocket.BinaryMessage, append([]byte{cmdConfig}, doc...))
+}
+
+// onConfigAck device acknowledge config, packet: op(1) + json configAck
+func (relay *Relay) onConfigAck(d *Device, message []byte) {
+	ack := &configAck{}
+	err := json.Unmarshal(message[1:], ack)
+	if err != nil {
+		log.Errorf("onConfigAck invalid message:%v", err)
+		return
+	}
+
+	if ack.Error != "" {
+		log.Warnf("device %s reject config version %d:%s", d.uuid, ack.Version, ack.Error)
+		return
+	}
+
+	d.configLock.Lock()
+	d.configVersion = ack.Version
+	d.configLock.Unlock()
+
+	log.Printf("device %s applied config version %d", d.uuid, ack.Version)
+}
+
+// checkConfigs push config to devices, if config dir changed
+func (relay *Relay) checkConfigs() {
+	if !relay.scanConfigs() {
+		return
+	}
+
+	relay.devices.each(func(d *Device) {
+		relay.pushConfig(d)
+	})
+}
@@ -1,46 +1,90 @@
 package tunpair
 
 import (
+	"time"
+
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
-// handlePairDevice handle pair-able device register
-func handlePairDevice(c *websocket.Conn, uuid string) {
+// handlePairDevice handle pair-able device register,
+// the device join pool if pool is not empty
+func (relay *Relay) handlePairDevice(c *websocket.Conn, uuid string, pool string, info *deviceInfo) {
 	if uuid == "" {
 		log.Println("handlePairDevice need uuid provided")
 		return
 	}
 
 	peerAddr := c.RemoteAddr()
-	log.Println("handlePairDevice accept device websocket from:", peerAddr)
+	log.Printf("handlePairDevice accept device websocket from:%s, pool:%s, version:%s",
+		peerAddr, pool, info.version)
 	defer c.Close()
 
-	// if we have old websocket connection of this device, wait it to exit
-	old, ok := devices[uuid]
-	if ok {
-		old.close()
-		// wait
-		old.wg.Wait()
-		log.Println("handlePairDevice wait old device exit ok:", uuid)
+	// if we have old websocket connection of this device, apply duplicate policy
+	olds := relay.devices.members(uuid)
+	if len(olds) > 0 {
+		relay.onDeviceConflict(uuid, olds, peerAddr.String())
+
+		switch relay.dupPolicy {
+		case DupReject:
+			log.Printf("handlePairDevice reject duplicate device:%s, from:%s", uuid, peerAddr)
+			msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "duplicate device uuid")
+			c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return
+		case DupPool:
+			// keep old devices, the new one join them
+		default:
+			for _, old := range olds {
+				old.close()
+				// wait
+				old.wg.Wait()
+			}
+			log.Println("handlePairDevice wait old device exit ok:", uuid)
+		}
 	}
 
 	// create new device and add to devices map
-	new := newDevice(uuid, c)
-	_, ok = devices[uuid]
-	if ok {
+	new := newDevice(uuid, pool, c)
+	new.info = *info
+	new.configVersion = info.config
+	if !relay.devices.add(uuid, new, relay.dupPolicy == DupPool) {
 		log.Println("handlePairDevice try to add device conflict")
 		return
 	}
 
-	devices[uuid] = new
+	if pool != "" {
+		relay.pools.add(pool, new, true)
+	}
+
 	new.wg.Add(1)
 	defer func() {
 		// remove from devices map
-		delete(devices, uuid)
+		relay.devices.remove(uuid, new)
+		if pool != "" {
+			relay.pools.remove(pool, new)
+		}
+		// reverse listeners are gone with device
+		relay.closeReverses(new)
 		new.wg.Done()
 	}()
 
+	// device may need update
+	relay.advertiseUpdate(new, relay.updateVersion())
+	// device may need new config
+	relay.pushConfig(new)
+
 	// read device's websocket message
-	new.loopMsg()
+	new.loopMsg(relay.onDeviceMessage)
+}
+
+// onDeviceConflict log and alert that a device register with an uuid already in use
+func (relay *Relay) onDeviceConflict(uuid string, olds []*Device, newAddr string) {
+	for _, old := range olds {
+		log.Warnf("device conflict, uuid:%s, old:%s, new:%s, policy:%s",
+			uuid, old.remoteAddr, newAddr, relay.dupPolicy)
+
+		if relay.conflictHandler != nil {
+			relay.conflictHandler(uuid, old.remoteAddr, newAddr)
+		}
+	}
 }
@@ -2,17 +2,86 @@ package tunpair
 
 import (
 	"encoding/binary"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
 
+// command that server send to device
+const (
+	// cmdPairCreate ask device to create pair
+	cmdPairCreate = 0
+	// cmdGoingAway server is going away, device should reconnect
+	cmdGoingAway = 1
+	// cmdPairCreateExt ask device to create pair with kind and meta
+	cmdPairCreateExt = 2
+	// cmdReverseListen ask device to listen for reverse forwarding
+	cmdReverseListen = 3
+	// cmdReverseClose ask device to close reverse forwarding listener
+	cmdReverseClose = 4
+	// cmdLinkResponse response device's link request
+	cmdLinkResponse = 5
+	// cmdUpdate advertise new build of endpoint server
+	cmdUpdate = 6
+	// cmdConfig push config document to device
+	cmdConfig = 7
+)
+
+// device commands, from device to server
+const (
+	// devLinkRequest device request to link to another device
+	devLinkRequest = 0x80
+	// devConfigAck device acknowledge config document
+	devConfigAck = 0x81
+	// devReverseAck device report result of reverse listen
+	devReverseAck = 0x82
+)
+
+// pair kinds of cmdPairCreateExt
+const (
+	// pairKindTCP tcp stream to host:port
+	pairKindTCP = 0
+	// pairKindVPN ip packets, device forward them via tun interface
+	pairKindVPN = 1
+	// pairKindUDP udp datagrams framed with association id
+	pairKindUDP = 2
+	// pairKindShell terminal, device spawn shell with pty
+	pairKindShell = 3
+	// pairKindExec non-interactive command, device stream its output
+	pairKindExec = 4
+	// pairKindFile file transfer, device serve files under root directories
+	pairKindFile = 5
+)
+
 // Device a device, identify with it's uuid
 type Device struct {
 	// unique identifier
 	uuid string
+	// remote address of device's websocket
+	remoteAddr string
+	// pool that the device belongs to, may be empty
+	pool string
+	// information reported by device when register
+	info deviceInfo
+
+	// protect configVersion and configPushed
+	configLock sync.Mutex
+	// config version that device applied
+	configVersion int64
+	// config version last pushed to device, not push again
+	// if device reject it
+	configPushed int64
+
+	// for reverse forwarding endpoint-c, the device that listen for it
+	owner *Device
+	// for reverse forwarding endpoint-c, the port that device listen on
+	port uint16
+	// for reverse forwarding endpoint-c, result of device listen
+	listenAck chan bool
 
 	// device's websocket
 	conn *websocket.Conn
@@ -22,12 +91,19 @@ type Device struct {
 	wg sync.WaitGroup
 	// ping meesage that waiting for response counter
 	waitingPingCount int
+
+	// current pair count, access atomically
+	pairCount int32
+	// last measured round-trip time in nanoseconds, access atomically
+	rtt int64
 }
 
-func newDevice(uuid string, conn *websocket.Conn) *Device {
+func newDevice(uuid string, pool string, conn *websocket.Conn) *Device {
 	d := &Device{
-		uuid: uuid,
-		conn: conn,
+		uuid:       uuid,
+		pool:       pool,
+		conn:       conn,
+		remoteAddr: conn.RemoteAddr().String(),
 	}
 
 	// ping/pong handlers
@@ -53,7 +129,7 @@ func (d *Device) close() {
 }
 
 // loopMsg read message from device websocket
-func (d *Device) loopMsg() {
+func (d *Device) loopMsg(onMsg func(d *Device, message []byte)) {
 	c := d.conn
 	for {
 		_, message, err := c.ReadMessage()
@@ -62,8 +138,12 @@ func (d *Device) loopMsg() {
 			break
 		}
 
-		// the device currently not send anything to server
-		log.Println("recv dev msg length: ", len(message))
+		if onMsg == nil {
+			log.Println("recv dev msg length: ", len(message))
+			continue
+		}
+
+		onMsg(d, message)
 	}
 
 	d.close()
@@ -78,9 +158,34 @@ func (d *Device) writePong(data []byte) {
 	d.write(websocket.PongMessage, data)
 }
 
-// onPong reset ping counter
+// onPong reset ping counter, and measure round-trip time
+// with the timestamp carried by ping message
 func (d *Device) onPong(data []byte) {
 	d.waitingPingCount = 0
+
+	if len(data) == 8 {
+		sent := int64(binary.LittleEndian.Uint64(data))
+		rtt := time.Now().UnixNano() - sent
+		if rtt > 0 {
+			atomic.StoreInt64(&d.rtt, rtt)
+		}
+	}
+}
+
+// activePairs current pair count of device
+func (d *Device) activePairs() int32 {
+	return atomic.LoadInt32(&d.pairCount)
+}
+
+// rttOrMax last measured round-trip time, if it has not
+// been measured yet, return max value
+func (d *Device) rttOrMax() int64 {
+	rtt := atomic.LoadInt64(&d.rtt)
+	if rtt == 0 {
+		return math.MaxInt64
+	}
+
+	return rtt
 }
 
 // write write message with type to websocket
@@ -110,7 +215,8 @@ func (d *Device) keepalive() {
 		return
 	}
 
-	now := time.Now().Unix()
+	// nanoseconds timestamp, the device echo it back in pong
+	now := time.Now().UnixNano()
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, uint64(now))
 	d.write(websocket.PingMessage, b)
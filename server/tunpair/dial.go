@@ -0,0 +1,81 @@
+package tunpair
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	gouuid "github.com/satori/go.uuid"
+)
+
+// Dial create pair stream to local port of device, that server itself is
+// master, eg. for proxy. Return after device has connected to the port,
+// the pair is closed when the returned connection closed
+func (relay *Relay) Dial(ctx context.Context, device string, port uint16) (net.Conn, error) {
+	dev := relay.devices.wait(device)
+	if dev == nil {
+		return nil, ErrDeviceNotFound
+	}
+
+	pairUUID, err := gouuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	// local end is returned, slave's messages are written to remote end
+	local, remote := net.Pipe()
+	onMessage := func(message []byte) {
+		remote.Write(message)
+	}
+
+	pair := newLocalPair(pairUUID.String(), dev, onMessage)
+	relay.addPair(pair)
+	atomic.AddInt32(&dev.pairCount, 1)
+
+	release := func() {
+		remote.Close()
+		relay.removePair(pair)
+		atomic.AddInt32(&dev.pairCount, -1)
+	}
+
+	pair.sendPairCreateReq(&pairRequest{uuid: device, port: port})
+
+	select {
+	case <-pair.pch:
+	case <-time.After(relay.pairSetupTimeout):
+		pair.start(false)
+		local.Close()
+		release()
+		return nil, ErrDeviceNoResponse
+	case <-ctx.Done():
+		pair.start(false)
+		local.Close()
+		release()
+		return nil, ctx.Err()
+	}
+
+	pair.start(true)
+
+	// forward what written to local end to slave
+	go func() {
+		b := make([]byte, 32*1024)
+		for {
+			n, err := remote.Read(b)
+			if err != nil {
+				break
+			}
+
+			pair.writeSlave(websocket.BinaryMessage, b[:n])
+		}
+		pair.closeSlave()
+	}()
+
+	go func() {
+		<-pair.done
+		release()
+	}()
+
+	return local, nil
+}
@@ -0,0 +1,120 @@
+package tunpair
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// exec message ops, from device: op(1) + payload
+const (
+	// execOpExit exit with json ExecResult, the last message
+	execOpExit = 0
+	// ExecStdout stdout data
+	ExecStdout = 1
+	// ExecStderr stderr data
+	ExecStderr = 2
+)
+
+// ExecRequest command to execute on device
+type ExecRequest struct {
+	// command and arguments, not interpreted by shell
+	Command []string `json:"command"`
+	// timeout in seconds, device decide it if 0
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// ExecResult exit status of command
+type ExecResult struct {
+	// exit code, -1 if not exited normally
+	Code int `json:"code"`
+	// error message if command can not run, or killed by timeout
+	Error string `json:"error,omitempty"`
+}
+
+// ErrDeviceNotFound device is offline
+var ErrDeviceNotFound = errors.New("device not found")
+
+// ErrDeviceNoResponse device not response pair create request
+var ErrDeviceNoResponse = errors.New("device not response")
+
+// Exec execute command on device, stdout and stderr data are delivered
+// to output as they arrive, return when command exited or ctx done
+func (relay *Relay) Exec(ctx context.Context, device string, req *ExecRequest,
+	output func(stream int, data []byte)) (*ExecResult, error) {
+	dev := relay.devices.wait(device)
+	if dev == nil {
+		return nil, ErrDeviceNotFound
+	}
+
+	pairUUID, err := gouuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	var result *ExecResult
+	onMessage := func(message []byte) {
+		if len(message) < 1 {
+			return
+		}
+
+		switch message[0] {
+		case execOpExit:
+			r := &ExecResult{}
+			if json.Unmarshal(message[1:], r) == nil {
+				result = r
+			}
+		case ExecStdout, ExecStderr:
+			if output != nil {
+				output(int(message[0]), message[1:])
+			}
+		}
+	}
+
+	pair := newLocalPair(pairUUID.String(), dev, onMessage)
+	relay.addPair(pair)
+
+	atomic.AddInt32(&dev.pairCount, 1)
+	defer func() {
+		relay.removePair(pair)
+		atomic.AddInt32(&dev.pairCount, -1)
+	}()
+
+	meta := &pairMeta{
+		Command: req.Command,
+		Timeout: req.Timeout,
+	}
+	pair.sendPairCreateExt(pairKindExec, 0, meta)
+
+	select {
+	case <-pair.pch:
+	case <-time.After(relay.pairSetupTimeout):
+		pair.start(false)
+		return nil, ErrDeviceNoResponse
+	case <-ctx.Done():
+		pair.start(false)
+		return nil, ctx.Err()
+	}
+
+	pair.start(true)
+
+	select {
+	case <-pair.done:
+	case <-ctx.Done():
+		pair.closeSlave()
+		<-pair.done
+		return nil, ctx.Err()
+	}
+
+	if result == nil {
+		log.Printf("Exec device %s closed without exit status", device)
+		return nil, errors.New("device closed without exit status")
+	}
+
+	return result, nil
+}
@@ -0,0 +1,138 @@
+package tunpair
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	gouuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// FileInfo file information from device
+type FileInfo struct {
+	// size of file
+	Size int64 `json:"size"`
+	// offset that data is sent from, 0 if requested offset beyond size
+	Offset int64 `json:"offset,omitempty"`
+	// hex sha256 of whole file, if requested
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// FileError error reported by device, eg. file not found or not allowed
+type FileError struct {
+	Message string
+}
+
+func (e *FileError) Error() string {
+	return e.Message
+}
+
+// fileRequest the first message of file pair
+type fileRequest struct {
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	Offset int64  `json:"offset,omitempty"`
+	Sum    bool   `json:"sum,omitempty"`
+}
+
+// fileResponse response of device, data messages follow, and
+// an empty message marks the end
+type fileResponse struct {
+	FileInfo
+	Error string `json:"error,omitempty"`
+}
+
+// ReadFile read file of device from offset, header is called with file
+// information before data delivered to w. Return when all data delivered,
+// or ctx done
+func (relay *Relay) ReadFile(ctx context.Context, device string, path string, offset int64,
+	header func(info *FileInfo) error, w io.Writer) error {
+	dev := relay.devices.wait(device)
+	if dev == nil {
+		return ErrDeviceNotFound
+	}
+
+	pairUUID, err := gouuid.NewV4()
+	if err != nil {
+		return err
+	}
+
+	var pair *Pair
+	var resp *fileResponse
+	var werr error
+	eof := false
+	onMessage := func(message []byte) {
+		if werr != nil || eof {
+			return
+		}
+
+		if resp == nil {
+			resp = &fileResponse{}
+			if err := json.Unmarshal(message, resp); err != nil {
+				werr = err
+			} else if resp.Error != "" {
+				werr = &FileError{Message: resp.Error}
+			} else {
+				werr = header(&resp.FileInfo)
+			}
+		} else if len(message) == 0 {
+			eof = true
+		} else {
+			_, werr = w.Write(message)
+		}
+
+		if werr != nil || eof {
+			pair.closeSlave()
+		}
+	}
+
+	pair = newLocalPair(pairUUID.String(), dev, onMessage)
+	relay.addPair(pair)
+
+	atomic.AddInt32(&dev.pairCount, 1)
+	defer func() {
+		relay.removePair(pair)
+		atomic.AddInt32(&dev.pairCount, -1)
+	}()
+
+	pair.sendPairCreateExt(pairKindFile, 0, &pairMeta{})
+
+	select {
+	case <-pair.pch:
+	case <-time.After(relay.pairSetupTimeout):
+		pair.start(false)
+		return ErrDeviceNoResponse
+	case <-ctx.Done():
+		pair.start(false)
+		return ctx.Err()
+	}
+
+	pair.start(true)
+
+	req, _ := json.Marshal(&fileRequest{Op: "get", Path: path, Offset: offset})
+	pair.writeSlave(websocket.BinaryMessage, req)
+
+	select {
+	case <-pair.done:
+	case <-ctx.Done():
+		pair.closeSlave()
+		<-pair.done
+		return ctx.Err()
+	}
+
+	if werr != nil {
+		return werr
+	}
+
+	if !eof {
+		log.Printf("ReadFile device %s closed before end of %s", device, path)
+		return errors.New("device closed before end of file")
+	}
+
+	return nil
+}
@@ -0,0 +1,242 @@
+package tunpair
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// deviceGroup devices that registered with the same name, that is
+// the same uuid(only when duplicate policy is pool) or the same pool
+type deviceGroup struct {
+	name string
+
+	members []*Device
+	// round-robin cursor
+	next int
+}
+
+// add append device to group
+func (g *deviceGroup) add(d *Device) {
+	g.members = append(g.members, d)
+}
+
+// remove remove device from group, return false if not found
+func (g *deviceGroup) remove(d *Device) bool {
+	for i, m := range g.members {
+		if m == d {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// pick select a member by strategy, skip devices in exclude
+func (g *deviceGroup) pick(strategy Strategy, exclude map[*Device]struct{}) *Device {
+	var best *Device
+	for i := 0; i < len(g.members); i++ {
+		// start from round-robin cursor, so that ties are spread
+		d := g.members[(g.next+i)%len(g.members)]
+		if _, ok := exclude[d]; ok {
+			continue
+		}
+
+		if best == nil {
+			best = d
+			if strategy == RoundRobin {
+				break
+			}
+			continue
+		}
+
+		switch strategy {
+		case LeastPairs:
+			if d.activePairs() < best.activePairs() {
+				best = d
+			}
+		case LowestRTT:
+			if d.rttOrMax() < best.rttOrMax() {
+				best = d
+			}
+		}
+	}
+
+	if best != nil {
+		g.next++
+	}
+
+	return best
+}
+
+// groupSet device groups index by name, and pair requests
+// that are waiting for offline groups. Protected by relay's devLock
+type groupSet struct {
+	relay *Relay
+
+	groups map[string]*deviceGroup
+	// group names that have online members before
+	known map[string]struct{}
+	// pair requests that waiting for offline group to come back
+	waiters map[string][]chan *Device
+}
+
+func newGroupSet(relay *Relay) *groupSet {
+	return &groupSet{
+		relay:   relay,
+		groups:  make(map[string]*deviceGroup),
+		known:   make(map[string]struct{}),
+		waiters: make(map[string][]chan *Device),
+	}
+}
+
+// members get all online devices with name
+func (gs *groupSet) members(name string) []*Device {
+	gs.relay.devLock.Lock()
+	defer gs.relay.devLock.Unlock()
+
+	g, ok := gs.groups[name]
+	if !ok {
+		return nil
+	}
+
+	return append([]*Device(nil), g.members...)
+}
+
+// pick select an online device of group
+func (gs *groupSet) pick(name string, exclude map[*Device]struct{}) *Device {
+	gs.relay.devLock.Lock()
+	defer gs.relay.devLock.Unlock()
+
+	g, ok := gs.groups[name]
+	if !ok {
+		return nil
+	}
+
+	return g.pick(gs.relay.strategy, exclude)
+}
+
+// add add device to group, and hand it to all pair requests
+// that are waiting for the group.
+// if multi is false, the group can only have one member
+func (gs *groupSet) add(name string, d *Device, multi bool) bool {
+	gs.relay.devLock.Lock()
+	defer gs.relay.devLock.Unlock()
+
+	g, ok := gs.groups[name]
+	if !ok {
+		g = &deviceGroup{name: name}
+		gs.groups[name] = g
+	}
+
+	if len(g.members) > 0 && !multi {
+		return false
+	}
+
+	g.add(d)
+	gs.known[name] = struct{}{}
+
+	// flush pending pair requests
+	pending := gs.waiters[name]
+	delete(gs.waiters, name)
+	for _, ch := range pending {
+		ch <- g.pick(gs.relay.strategy, nil)
+	}
+
+	if len(pending) > 0 {
+		log.Printf("groupSet add %s, flush %d pending pair requests", name, len(pending))
+	}
+
+	return true
+}
+
+// remove remove device from group
+func (gs *groupSet) remove(name string, d *Device) {
+	gs.relay.devLock.Lock()
+	defer gs.relay.devLock.Unlock()
+
+	g, ok := gs.groups[name]
+	if !ok {
+		return
+	}
+
+	g.remove(d)
+	if len(g.members) == 0 {
+		delete(gs.groups, name)
+	}
+}
+
+// wait get online device of group, if the group is offline but
+// has been online before, wait it to come back until timeout
+func (gs *groupSet) wait(name string) *Device {
+	gs.relay.devLock.Lock()
+	g, ok := gs.groups[name]
+	if ok {
+		defer gs.relay.devLock.Unlock()
+		return g.pick(gs.relay.strategy, nil)
+	}
+
+	_, known := gs.known[name]
+	if !known || gs.relay.deviceWaitTimeout <= 0 {
+		gs.relay.devLock.Unlock()
+		return nil
+	}
+
+	// queue the request, add will flush it
+	ch := make(chan *Device, 1)
+	gs.waiters[name] = append(gs.waiters[name], ch)
+	gs.relay.devLock.Unlock()
+
+	log.Printf("groupSet %s offline, wait at most %s", name, gs.relay.deviceWaitTimeout)
+
+	var dev *Device
+	select {
+	case dev = <-ch:
+		return dev
+	case <-time.After(gs.relay.deviceWaitTimeout):
+	}
+
+	// timeout, remove from waiting queue
+	gs.relay.devLock.Lock()
+	defer gs.relay.devLock.Unlock()
+
+	waiters := gs.waiters[name]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(gs.waiters, name)
+	} else {
+		gs.waiters[name] = waiters
+	}
+
+	// device may come back just before we acquire the lock
+	select {
+	case dev = <-ch:
+		return dev
+	default:
+	}
+
+	return nil
+}
+
+// each call fn for every online device, a device in more than one
+// group will be called more than once. fn is called outside devLock,
+// with a snapshot of members, so that it may block, eg. write websocket
+func (gs *groupSet) each(fn func(d *Device)) {
+	gs.relay.devLock.Lock()
+	var devices []*Device
+	for _, g := range gs.groups {
+		devices = append(devices, g.members...)
+	}
+	gs.relay.devLock.Unlock()
+
+	for _, d := range devices {
+		fn(d)
+	}
+}
@@ -0,0 +1,172 @@
+package tunpair
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	gouuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// link request status of cmdLinkResponse
+const (
+	linkOK     = 0
+	linkDenied = 1
+	linkFailed = 2
+)
+
+// how long a granted link token can be used
+const linkTokenTimeout = 30 * time.Second
+
+// linkRule allow device From link to device To, "*" match any device,
+// To with "@" prefix is a pool
+type linkRule struct {
+	from string
+	to   string
+}
+
+// pendingLink granted link, wait device to connect with the token
+type pendingLink struct {
+	from   string
+	to     string
+	port   uint16
+	expire time.Time
+}
+
+// parseLinkRules parse rules in format "from:to"
+func parseLinkRules(rules []string) []linkRule {
+	var lrs []linkRule
+	for _, r := range rules {
+		parts := strings.SplitN(strings.TrimSpace(r), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.Warnf("tunpair invalid link rule:%s, ignore", r)
+			continue
+		}
+
+		lrs = append(lrs, linkRule{from: parts[0], to: parts[1]})
+	}
+
+	return lrs
+}
+
+// allowLink check if device from can link to target
+func (relay *Relay) allowLink(from string, to string) bool {
+	for _, r := range relay.linkRules {
+		if (r.from == "*" || r.from == from) && (r.to == "*" || r.to == to) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// onDeviceMessage handle message from device's command websocket
+func (relay *Relay) onDeviceMessage(d *Device, message []byte) {
+	if len(message) == 0 {
+		return
+	}
+
+	switch message[0] {
+	case devLinkRequest:
+		relay.onLinkRequest(d, message)
+	case devConfigAck:
+		relay.onConfigAck(d, message)
+	case devReverseAck:
+		relay.onReverseAck(d, message)
+	default:
+		log.Errorf("device %s unsupport operation:%d", d.uuid, message[0])
+	}
+}
+
+// onLinkRequest device request to link to port of another device,
+// packet: op(1) + request id(4) + port(2) + target device uuid,
+// a token is granted if allowed, device then connect with it
+func (relay *Relay) onLinkRequest(d *Device, message []byte) {
+	if len(message) < 8 {
+		log.Errorf("onLinkRequest invalid message length:%d", len(message))
+		return
+	}
+
+	reqID := message[1:5]
+	port := binary.LittleEndian.Uint16(message[5:7])
+	to := string(message[7:])
+
+	if !relay.allowLink(d.uuid, to) {
+		log.Warnf("onLinkRequest device %s link to %s:%d not allowed", d.uuid, to, port)
+		sendLinkResponse(d, reqID, linkDenied, "")
+		return
+	}
+
+	token, err := gouuid.NewV4()
+	if err != nil {
+		log.Printf("onLinkRequest Something went wrong: %s", err)
+		sendLinkResponse(d, reqID, linkFailed, "")
+		return
+	}
+
+	relay.linkLock.Lock()
+	relay.links[token.String()] = &pendingLink{
+		from:   d.uuid,
+		to:     to,
+		port:   port,
+		expire: time.Now().Add(linkTokenTimeout),
+	}
+	relay.linkLock.Unlock()
+
+	log.Printf("onLinkRequest device %s link to %s:%d granted", d.uuid, to, port)
+	sendLinkResponse(d, reqID, linkOK, token.String())
+}
+
+// handleLinkRequest device connect with granted token, pair it with target
+func (relay *Relay) handleLinkRequest(c *websocket.Conn, token string, ready bool) {
+	relay.linkLock.Lock()
+	link := relay.links[token]
+	delete(relay.links, token)
+	relay.linkLock.Unlock()
+
+	if link == nil || time.Now().After(link.expire) {
+		log.Println("handleLinkRequest invalid or expired token:", token)
+		return
+	}
+
+	req := &pairRequest{
+		uuid:  link.to,
+		port:  link.port,
+		ready: ready,
+	}
+
+	if strings.HasPrefix(link.to, "@") {
+		req.uuid = ""
+		req.pool = link.to[1:]
+	}
+
+	log.Printf("handleLinkRequest device %s link to %s:%d", link.from, link.to, link.port)
+	relay.handlePairRequest(c, req)
+}
+
+// purgeLinks remove expired link tokens
+func (relay *Relay) purgeLinks() {
+	now := time.Now()
+
+	relay.linkLock.Lock()
+	for k, v := range relay.links {
+		if now.After(v.expire) {
+			delete(relay.links, k)
+		}
+	}
+	relay.linkLock.Unlock()
+}
+
+// sendLinkResponse response link request to device,
+// packet: op(1) + request id(4) + status(1) + token
+func sendLinkResponse(d *Device, reqID []byte, status byte, token string) {
+	bs := make([]byte, 6+len(token))
+	bs[0] = cmdLinkResponse
+	copy(bs[1:5], reqID)
+	bs[5] = status
+	copy(bs[6:], []byte(token))
+
+	d.write(websocket.BinaryMessage, bs)
+}
@@ -2,6 +2,7 @@ package tunpair
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"sync"
 	"time"
 
@@ -33,6 +34,16 @@ type Pair struct {
 
 	// a channel use to notify pair established
 	pch chan struct{}
+	// closed when master side is ready to receive slave's message
+	started chan struct{}
+	// set before started closed, if pair setup failed
+	failed bool
+
+	// for local pair that server itself is master,
+	// slave's messages are delivered to it
+	onSlaveMessage func(message []byte)
+	// closed when slave loop ended
+	done chan struct{}
 }
 
 func newPair(uuid string, dev *Device, master *websocket.Conn) *Pair {
@@ -41,6 +52,8 @@ func newPair(uuid string, dev *Device, master *websocket.Conn) *Pair {
 		masterConn: master,
 		dev:        dev,
 		pch:        make(chan struct{}, 1),
+		started:    make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 
 	// ping/pong handlers
@@ -57,6 +70,19 @@ func newPair(uuid string, dev *Device, master *websocket.Conn) *Pair {
 	return pair
 }
 
+// newLocalPair create pair that server itself is master,
+// slave's messages are delivered to onMessage
+func newLocalPair(uuid string, dev *Device, onMessage func(message []byte)) *Pair {
+	return &Pair{
+		uuid:           uuid,
+		dev:            dev,
+		pch:            make(chan struct{}, 1),
+		started:        make(chan struct{}),
+		done:           make(chan struct{}),
+		onSlaveMessage: onMessage,
+	}
+}
+
 // loopMaster read master websocket message and forward to slave websocket
 func (p *Pair) loopMaster() {
 	from := p.masterConn
@@ -87,12 +113,24 @@ func (p *Pair) loopSlave() {
 			break
 		}
 
+		if p.onSlaveMessage != nil {
+			p.onSlaveMessage(message)
+			continue
+		}
+
 		// bridge
 		p.writeMaster(websocket.BinaryMessage, message)
 	}
 
 	p.closeMaster()
 	p.closeSlave()
+	close(p.done)
+}
+
+// start notify slave side that master side is ready, or failed
+func (p *Pair) start(ok bool) {
+	p.failed = !ok
+	close(p.started)
 }
 
 // onSlaveConneted slave websocket has connected
@@ -111,11 +149,38 @@ func (p *Pair) onSlaveConneted(slave *websocket.Conn) {
 	p.slaveConn = slave
 }
 
+// pairMeta extra information of cmdPairCreateExt
+type pairMeta struct {
+	// target host that device connect to, instead of localhost
+	Host string `json:"host,omitempty"`
+	// device address of vpn pair, with prefix length
+	Addr string `json:"addr,omitempty"`
+	// endpoint-c address of vpn pair, with prefix length
+	Peer string `json:"peer,omitempty"`
+	// command and arguments of exec pair
+	Command []string `json:"command,omitempty"`
+	// timeout in seconds of exec pair
+	Timeout int `json:"timeout,omitempty"`
+}
+
 // sendPairCreateReq send pair create request to target device
-func (p *Pair) sendPairCreateReq(port uint16) {
+func (p *Pair) sendPairCreateReq(req *pairRequest) {
+	if req.host != "" || req.kind != pairKindTCP {
+		meta := &pairMeta{
+			Host: req.host,
+		}
+		if req.vpn != nil {
+			meta.Addr = req.vpn.Device
+			meta.Peer = req.vpn.Client
+		}
+		p.sendPairCreateExt(req.kind, req.port, meta)
+		return
+	}
+
+	port := req.port
 	// packet
 	bs := make([]byte, 3+len(p.uuid))
-	bs[0] = 0 // 0, pair create
+	bs[0] = cmdPairCreate
 	binary.LittleEndian.PutUint16(bs[1:], port)
 	copy(bs[3:], []byte(p.uuid))
 
@@ -123,6 +188,27 @@ func (p *Pair) sendPairCreateReq(port uint16) {
 	p.dev.write(websocket.BinaryMessage, bs)
 }
 
+// sendPairCreateExt send pair create request with kind and meta to target device,
+// packet: op(1) + kind(1) + port(2) + meta length(2) + meta json + pair uuid
+func (p *Pair) sendPairCreateExt(kind byte, port uint16, meta interface{}) {
+	mb, err := json.Marshal(meta)
+	if err != nil {
+		log.Println("sendPairCreateExt marshal meta failed:", err)
+		return
+	}
+
+	bs := make([]byte, 6+len(mb)+len(p.uuid))
+	bs[0] = cmdPairCreateExt
+	bs[1] = kind
+	binary.LittleEndian.PutUint16(bs[2:], port)
+	binary.LittleEndian.PutUint16(bs[4:], uint16(len(mb)))
+	copy(bs[6:], mb)
+	copy(bs[6+len(mb):], []byte(p.uuid))
+
+	// send to target device
+	p.dev.write(websocket.BinaryMessage, bs)
+}
+
 // writeMaster write to master websocket
 func (p *Pair) writeMaster(mt int, message []byte) {
 	if p.masterConn == nil {
@@ -6,7 +6,9 @@ package tunpair
 
 import (
 	"net/http"
+	"net/url"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,22 +16,31 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-var (
-	upgrader = websocket.Upgrader{
-		CheckOrigin: checkOrigin,
-	} // use default options
-
-	devices = make(map[string]*Device)
-	pairs   = make(map[string]*Pair)
-)
-
 func checkOrigin(_ *http.Request) bool {
 	return true
 }
 
-// PairWSHandler handle pair request and response connection
-func PairWSHandler(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+// pairRequest pair create request from endpoint-c
+type pairRequest struct {
+	// target device uuid
+	uuid string
+	// target pool, take precedence over uuid
+	pool string
+	// port that endpoint-s will connect to
+	port uint16
+	// optional, host in device's network that endpoint-s will connect to
+	host string
+	// send a text message to endpoint-c when pair established
+	ready bool
+	// pair kind, pairKindTCP by default
+	kind byte
+	// addresses of vpn pair
+	vpn *vpnLease
+}
+
+// ServeHTTP handle pair request and response connection
+func (relay *Relay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := relay.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("PairWSHandler upgrade:", err)
 		return
@@ -38,78 +49,186 @@ func PairWSHandler(w http.ResponseWriter, r *http.Request) {
 
 	query := r.URL.Query()
 	pairType := query.Get("pt")
+
+	// existing pairs can still response while draining
+	if relay.isDraining() && pairType != "resp" {
+		log.Println("PairWSHandler, server is draining, reject:", pairType)
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is going away")
+		c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		return
+	}
+
 	uuid := query.Get("uuid")
+	pool := query.Get("pool")
 
 	switch pairType {
 	case "dev":
 		// device register, from endpoint-s endpoint server
-		handlePairDevice(c, uuid)
+		info := &deviceInfo{
+			version: query.Get("ver"),
+			goos:    query.Get("os"),
+			goarch:  query.Get("arch"),
+		}
+		info.config, _ = strconv.ParseInt(query.Get("cfg"), 10, 64)
+		relay.handlePairDevice(c, uuid, pool, info)
 	case "req":
 		// port that endpoint-s will connect to
-		portStr := query.Get("port")
-		if portStr == "" {
-			log.Println("PairWSHandler, need port")
+		port, ok := queryPort(query)
+		if !ok {
 			return
 		}
-		port, err := strconv.Atoi(portStr)
-		if err != nil {
-			log.Println("PairWSHandler, need port, Atoi failed:", err)
-			return
+
+		req := &pairRequest{
+			uuid:  uuid,
+			pool:  pool,
+			port:  port,
+			host:  query.Get("host"),
+			ready: query.Get("ready") == "1",
 		}
 
-		handlePairRequest(c, uuid, uint16(port))
+		switch query.Get("kind") {
+		case "udp":
+			req.kind = pairKindUDP
+		case "file":
+			req.kind = pairKindFile
+		}
+		relay.handlePairRequest(c, req)
 	case "resp":
-		handlePairResponse(c, uuid)
+		relay.handlePairResponse(c, uuid)
+	case "vpn":
+		// endpoint-c request vpn to device
+		req := &pairRequest{
+			uuid:  uuid,
+			pool:  pool,
+			ready: query.Get("ready") == "1",
+		}
+		relay.handleVPNRequest(c, req)
+	case "rev":
+		// endpoint-c require device to listen on port
+		port, ok := queryPort(query)
+		if !ok {
+			return
+		}
+
+		relay.handleReverse(c, uuid, port)
+	case "rreq":
+		// device accept connection on reverse listener
+		relay.handleReverseRequest(c, uuid, query.Get("ready") == "1")
+	case "update":
+		// device download new build
+		relay.handleUpdateDownload(c, query.Get("os"), query.Get("arch"), query.Get("ver"))
+	case "link":
+		// device connect with granted link token
+		relay.handleLinkRequest(c, uuid, query.Get("ready") == "1")
 	default:
 		log.Println("PairWSHandler, unsupport pairtype:", pairType)
 	}
 }
 
-// handlePairRequest endpoint-c client require create new pair to endpoint-s
-func handlePairRequest(c *websocket.Conn, uuid string, port uint16) {
-	// get target device
-	dev, ok := devices[uuid]
-	if !ok {
-		log.Println("handlePairRequest no device found with uuid:", uuid)
-		return
+// queryPort get port from query
+func queryPort(query url.Values) (uint16, bool) {
+	portStr := query.Get("port")
+	if portStr == "" {
+		log.Println("PairWSHandler, need port")
+		return 0, false
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		log.Println("PairWSHandler, need port, parse failed:", err)
+		return 0, false
+	}
+
+	return uint16(port), true
+}
+
+// handlePairRequest endpoint-c client require create new pair to endpoint-s,
+// the target is the device with uuid, or a member of pool if pool is not empty
+func (relay *Relay) handlePairRequest(c *websocket.Conn, req *pairRequest) {
+	set := relay.devices
+	name := req.uuid
+	if req.pool != "" {
+		set = relay.pools
+		name = req.pool
 	}
 
+	// devices that have failed to response
+	tried := make(map[*Device]struct{})
+	for {
+		var dev *Device
+		if len(tried) == 0 {
+			// get target device, may wait it to come back
+			dev = set.wait(name)
+		} else {
+			// failover to next device
+			dev = set.pick(name, tried)
+		}
+
+		if dev == nil {
+			log.Printf("handlePairRequest no device found with uuid:%s, pool:%s, tried:%d",
+				req.uuid, req.pool, len(tried))
+			return
+		}
+
+		if relay.pairWithDevice(c, dev, req) {
+			return
+		}
+
+		tried[dev] = struct{}{}
+		log.Printf("handlePairRequest device %s(%s) not response, try next",
+			dev.uuid, dev.remoteAddr)
+	}
+}
+
+// pairWithDevice create pair to device, return false if the device
+// not response in time, otherwise bridge until the pair closed
+func (relay *Relay) pairWithDevice(c *websocket.Conn, dev *Device, req *pairRequest) bool {
 	// generate a new pair uuid
 	pairUUID, err := gouuid.NewV4()
 	if err != nil {
 		log.Printf("handlePairRequest Something went wrong: %s", err)
-		return
+		return true
 	}
 
 	puuid := pairUUID.String()
 	// create a new pair object
 	pair := newPair(puuid, dev, c)
-	pairs[puuid] = pair
+	relay.addPair(pair)
 
+	atomic.AddInt32(&dev.pairCount, 1)
 	defer func() {
 		// ensure pair will be deleted final
-		delete(pairs, puuid)
+		relay.removePair(pair)
+		atomic.AddInt32(&dev.pairCount, -1)
 	}()
 
 	// send pair creation request to target device
-	pair.sendPairCreateReq(port)
+	pair.sendPairCreateReq(req)
 
 	// wait the target device(endpoint-s) to reply or timeout
 	select {
 	case <-pair.pch:
-	case <-time.After(5 * time.Second):
+	case <-time.After(relay.pairSetupTimeout):
 		log.Println("handlePairRequest, timeout")
-		return
+		pair.start(false)
+		return false
+	}
+
+	if req.ready {
+		pair.writeMaster(websocket.TextMessage, []byte("ok"))
 	}
+	// slave's message must not reach master before "ok"
+	pair.start(true)
 
 	// read all master websocket message and forward to slave websocket
 	pair.loopMaster()
+	return true
 }
 
 // handlePairResponse endpoint-s response that the pair has created
-func handlePairResponse(c *websocket.Conn, uuid string) {
-	pair, ok := pairs[uuid]
-	if !ok {
+func (relay *Relay) handlePairResponse(c *websocket.Conn, uuid string) {
+	pair := relay.getPair(uuid)
+	if pair == nil {
 		log.Println("handlePairResponse no pair found with uuid:", uuid)
 		return
 	}
@@ -120,17 +239,13 @@ func handlePairResponse(c *websocket.Conn, uuid string) {
 	// that the pair has established
 	pair.pch <- struct{}{}
 
-	// read all slave websocket message and forward to master websocket
-	pair.loopSlave()
-}
-
-// Keepalive do keepalive and check
-func Keepalive() {
-	for _, v := range devices {
-		v.keepalive()
+	// wait master side ready
+	<-pair.started
+	if pair.failed {
+		log.Println("handlePairResponse pair setup failed, uuid:", uuid)
+		return
 	}
 
-	for _, v := range pairs {
-		v.keepalive()
-	}
+	// read all slave websocket message and forward to master websocket
+	pair.loopSlave()
 }
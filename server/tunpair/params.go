@@ -0,0 +1,65 @@
+package tunpair
+
+import (
+	"time"
+)
+
+// DupPolicy policy that apply when a device register with
+// an uuid that is already registered by another device
+type DupPolicy string
+
+const (
+	// DupReplace close the old device, accept the new one
+	DupReplace DupPolicy = "replace"
+	// DupReject keep the old device, reject the new one
+	DupReject DupPolicy = "reject"
+	// DupPool keep both, pair requests are load-balanced among them
+	DupPool DupPolicy = "pool"
+)
+
+// Strategy strategy to select a device from pool
+type Strategy string
+
+const (
+	// RoundRobin select device one by one
+	RoundRobin Strategy = "rr"
+	// LeastPairs select device with least active pairs
+	LeastPairs Strategy = "least"
+	// LowestRTT select device with lowest keepalive round-trip time
+	LowestRTT Strategy = "rtt"
+)
+
+// ConflictHandler called when a device register with an uuid
+// that is already in use, with both remote addresses
+type ConflictHandler func(uuid string, oldAddr string, newAddr string)
+
+// Params parameters
+type Params struct {
+	// wait time for offline device when pair request arrived
+	DeviceWaitTimeout time.Duration
+	// duplicate device registration policy, default is DupReplace
+	DupPolicy DupPolicy
+	// optional, called when duplicate device registration occurs
+	OnConflict ConflictHandler
+	// device select strategy of pool, default is RoundRobin
+	Strategy Strategy
+	// how long to wait the device to response pair create request,
+	// if timeout, try next device of pool. Default is 5 seconds
+	PairSetupTimeout time.Duration
+	// allow endpoint-c to request device to listen for reverse forwarding
+	AllowReverse bool
+	// rules "from:to" that device from can link to device to,
+	// "*" match any device, to with "@" prefix is a pool
+	LinkRules []string
+	// ipv4 subnet that vpn addresses allocated from, empty disables vpn
+	VPNSubnet string
+	// client networks(CIDR) that allowed to start vpn pair
+	VPNClients []string
+	// directory of endpoint server builds, that devices update to,
+	// contains version file, es-<os>-<arch> binaries and their .sig
+	// signature files. Empty disables update
+	UpdateDir string
+	// directory of device config documents, <uuid>.json or default.json,
+	// pushed to device if version differ. Empty disables config push
+	ConfigDir string
+}
@@ -0,0 +1,219 @@
+package tunpair
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// Relay pair endpoint-c and endpoint-s, keep all devices and pairs
+type Relay struct {
+	upgrader websocket.Upgrader
+
+	// how long a pair request waits for a known but
+	// currently offline device to come back, 0 means do not wait
+	deviceWaitTimeout time.Duration
+	// duplicate device registration policy
+	dupPolicy DupPolicy
+	// alert handler for duplicate device registration
+	conflictHandler ConflictHandler
+	// device select strategy of pool
+	strategy Strategy
+	// how long to wait the device to response pair create request
+	pairSetupTimeout time.Duration
+
+	// protect devices and pools
+	devLock sync.Mutex
+	// devices index by uuid
+	devices *groupSet
+	// devices index by pool name
+	pools *groupSet
+	// reverse forwarding endpoint-c index by reverse id
+	reverses *groupSet
+	// allow endpoint-c to request reverse forwarding
+	allowReverse bool
+
+	// device to device link rules
+	linkRules []linkRule
+	// protect links
+	linkLock sync.Mutex
+	// granted links index by token
+	links map[string]*pendingLink
+
+	// vpn addresses allocator, nil if vpn disabled
+	vpnPool *vpnPool
+	// client networks that allowed to start vpn pair
+	vpnClients []*net.IPNet
+
+	// directory of endpoint server builds
+	updateDir string
+	// version in update dir last checked, protected by devLock
+	lastUpdateVersion string
+	// directory of device config documents
+	configDir string
+	// protect configFiles
+	configLock sync.Mutex
+	// config documents in config dir index by file name
+	configFiles map[string]*configFile
+
+	// protect pairs
+	pairLock sync.Mutex
+	pairs    map[string]*Pair
+
+	// set when draining, access atomically
+	draining int32
+}
+
+// NewRelay create relay with parameters
+func NewRelay(params *Params) *Relay {
+	relay := &Relay{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: checkOrigin,
+		},
+		deviceWaitTimeout: params.DeviceWaitTimeout,
+		conflictHandler:   params.OnConflict,
+		pairSetupTimeout:  5 * time.Second,
+		pairs:             make(map[string]*Pair),
+		links:             make(map[string]*pendingLink),
+		linkRules:         parseLinkRules(params.LinkRules),
+	}
+
+	relay.devices = newGroupSet(relay)
+	relay.pools = newGroupSet(relay)
+	relay.reverses = newGroupSet(relay)
+	relay.allowReverse = params.AllowReverse
+	relay.updateDir = params.UpdateDir
+	relay.configDir = params.ConfigDir
+	relay.scanConfigs()
+	relay.lastUpdateVersion = relay.updateVersion()
+
+	if params.VPNSubnet != "" {
+		relay.vpnPool = newVPNPool(params.VPNSubnet)
+		relay.vpnClients = parseVPNClients(params.VPNClients)
+		if len(relay.vpnClients) == 0 {
+			log.Warn("tunpair vpn enabled, but no client allowed")
+		}
+	}
+
+	switch params.DupPolicy {
+	case DupReplace, DupReject, DupPool:
+		relay.dupPolicy = params.DupPolicy
+	case "":
+		relay.dupPolicy = DupReplace
+	default:
+		log.Warnf("tunpair unknown duplicate policy:%s, use %s", params.DupPolicy, DupReplace)
+		relay.dupPolicy = DupReplace
+	}
+
+	switch params.Strategy {
+	case RoundRobin, LeastPairs, LowestRTT:
+		relay.strategy = params.Strategy
+	case "":
+		relay.strategy = RoundRobin
+	default:
+		log.Warnf("tunpair unknown pool strategy:%s, use %s", params.Strategy, RoundRobin)
+		relay.strategy = RoundRobin
+	}
+
+	if params.PairSetupTimeout > 0 {
+		relay.pairSetupTimeout = params.PairSetupTimeout
+	}
+
+	return relay
+}
+
+// addPair save pair
+func (relay *Relay) addPair(p *Pair) {
+	relay.pairLock.Lock()
+	relay.pairs[p.uuid] = p
+	relay.pairLock.Unlock()
+}
+
+// getPair get pair by uuid
+func (relay *Relay) getPair(uuid string) *Pair {
+	relay.pairLock.Lock()
+	defer relay.pairLock.Unlock()
+
+	return relay.pairs[uuid]
+}
+
+// removePair delete pair
+func (relay *Relay) removePair(p *Pair) {
+	relay.pairLock.Lock()
+	if relay.pairs[p.uuid] == p {
+		delete(relay.pairs, p.uuid)
+	}
+	relay.pairLock.Unlock()
+}
+
+// Drain stop accepting new devices and pairs, and notify all
+// devices that server is going away, existing pairs are kept
+func (relay *Relay) Drain() {
+	atomic.StoreInt32(&relay.draining, 1)
+
+	relay.devices.each(func(d *Device) {
+		d.write(websocket.BinaryMessage, []byte{cmdGoingAway})
+	})
+}
+
+// isDraining return true if Drain has been called
+func (relay *Relay) isDraining() bool {
+	return atomic.LoadInt32(&relay.draining) != 0
+}
+
+// ActivePairs current pair count
+func (relay *Relay) ActivePairs() int {
+	relay.pairLock.Lock()
+	defer relay.pairLock.Unlock()
+
+	return len(relay.pairs)
+}
+
+// Close close all devices and pairs
+func (relay *Relay) Close() {
+	relay.devices.each(func(d *Device) {
+		d.close()
+	})
+
+	relay.reverses.each(func(d *Device) {
+		d.close()
+	})
+
+	relay.pairLock.Lock()
+	for _, v := range relay.pairs {
+		v.closeMaster()
+		v.closeSlave()
+	}
+	relay.pairLock.Unlock()
+}
+
+// Keepalive do keepalive and check
+func (relay *Relay) Keepalive() {
+	// device in pool also in devices
+	relay.devices.each(func(d *Device) {
+		d.keepalive()
+	})
+
+	relay.reverses.each(func(d *Device) {
+		d.keepalive()
+	})
+
+	relay.purgeLinks()
+	relay.checkUpdate()
+	relay.checkConfigs()
+
+	relay.pairLock.Lock()
+	ps := make([]*Pair, 0, len(relay.pairs))
+	for _, v := range relay.pairs {
+		ps = append(ps, v)
+	}
+	relay.pairLock.Unlock()
+
+	for _, v := range ps {
+		v.keepalive()
+	}
+}
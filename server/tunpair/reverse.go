@@ -0,0 +1,134 @@
+package tunpair
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/gorilla/websocket"
+	gouuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleReverse endpoint-c require device to listen on port, connections
+// to the port are paired back to endpoint-c. The endpoint-c websocket act
+// as a device, which receive pair create request, identified by reverse id
+func (relay *Relay) handleReverse(c *websocket.Conn, uuid string, port uint16) {
+	if !relay.allowReverse {
+		log.Println("handleReverse reverse forwarding not allowed, device:", uuid)
+		return
+	}
+
+	target := relay.devices.wait(uuid)
+	if target == nil {
+		log.Println("handleReverse no device found with uuid:", uuid)
+		return
+	}
+
+	revUUID, err := gouuid.NewV4()
+	if err != nil {
+		log.Printf("handleReverse Something went wrong: %s", err)
+		return
+	}
+
+	revID := revUUID.String()
+	rev := newDevice(revID, "", c)
+	rev.owner = target
+	rev.port = port
+	rev.listenAck = make(chan bool, 1)
+	if !relay.reverses.add(revID, rev, false) {
+		return
+	}
+
+	rev.wg.Add(1)
+	defer func() {
+		relay.reverses.remove(revID, rev)
+		rev.wg.Done()
+
+		// ask device to close the listener
+		sendReverseCmd(target, cmdReverseClose, port, revID)
+	}()
+
+	// ask device to listen, tell endpoint-c only after device listened
+	sendReverseCmd(target, cmdReverseListen, port, revID)
+
+	ok := false
+	select {
+	case ok = <-rev.listenAck:
+	case <-time.After(relay.pairSetupTimeout):
+	}
+
+	if !ok {
+		log.Printf("handleReverse device %s failed to listen on port %d", uuid, port)
+		msg := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "device listen failed")
+		c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		return
+	}
+	rev.write(websocket.TextMessage, []byte("ok"))
+
+	log.Printf("handleReverse device %s listen on port %d for %s, reverse id:%s",
+		uuid, port, c.RemoteAddr(), revID)
+
+	// read until endpoint-c closed
+	rev.loopMsg(nil)
+}
+
+// handleReverseRequest device accept a connection on reverse listener,
+// create pair to endpoint-c that own the reverse listener
+func (relay *Relay) handleReverseRequest(c *websocket.Conn, revID string, ready bool) {
+	rev := relay.reverses.pick(revID, nil)
+	if rev == nil {
+		log.Println("handleReverseRequest no reverse found with id:", revID)
+		return
+	}
+
+	req := &pairRequest{
+		uuid:  revID,
+		port:  rev.port,
+		ready: ready,
+	}
+
+	if !relay.pairWithDevice(c, rev, req) {
+		log.Println("handleReverseRequest endpoint-c not response, reverse id:", revID)
+	}
+}
+
+// closeReverses close reverse listeners that owned by device
+func (relay *Relay) closeReverses(owner *Device) {
+	relay.reverses.each(func(d *Device) {
+		if d.owner == owner {
+			d.close()
+		}
+	})
+}
+
+// onReverseAck device report result of reverse listen,
+// packet: op(1) + status(1) + reverse id
+func (relay *Relay) onReverseAck(d *Device, message []byte) {
+	if len(message) < 3 {
+		log.Errorf("onReverseAck invalid message length:%d", len(message))
+		return
+	}
+
+	revID := string(message[2:])
+	rev := relay.reverses.pick(revID, nil)
+	if rev == nil || rev.owner != d {
+		log.Println("onReverseAck no reverse found with id:", revID)
+		return
+	}
+
+	select {
+	case rev.listenAck <- message[1] == 0:
+	default:
+	}
+}
+
+// sendReverseCmd send reverse listen/close command to device,
+// packet: op(1) + port(2) + reverse id
+func sendReverseCmd(d *Device, op byte, port uint16, revID string) {
+	bs := make([]byte, 3+len(revID))
+	bs[0] = op
+	binary.LittleEndian.PutUint16(bs[1:], port)
+	copy(bs[3:], []byte(revID))
+
+	d.write(websocket.BinaryMessage, bs)
+}
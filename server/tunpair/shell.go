@@ -0,0 +1,17 @@
+package tunpair
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// ServeShell pair terminal websocket(from web-browser) with shell of device,
+// messages are relayed as is: op(1) + payload, op 0 data, 1 ping, 2 pong,
+// 3 resize with json {rows, cols}. Return when either side closed
+func (relay *Relay) ServeShell(c *websocket.Conn, device string) {
+	req := &pairRequest{
+		uuid: device,
+		kind: pairKindShell,
+	}
+
+	relay.handlePairRequest(c, req)
+}
@@ -0,0 +1,225 @@
+package tunpair
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// size of each binary message when device download update
+const updateChunkSize = 32 * 1024
+
+// deviceInfo information reported by device when register
+type deviceInfo struct {
+	version string
+	goos    string
+	goarch  string
+	// config version that device applied
+	config int64
+}
+
+// updateAdvert update advertisement, sent to device with cmdUpdate
+type updateAdvert struct {
+	Version string `json:"version"`
+	// json updateManifest, exactly the bytes that signed
+	Manifest string `json:"manifest"`
+	// base64 detached ed25519 signature of the manifest
+	Sig string `json:"sig"`
+}
+
+// updateManifest describe a build, device verify signature of it,
+// then verify binary by sha256 of it
+type updateManifest struct {
+	Version string `json:"version"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	Size    int64  `json:"size"`
+	// hex sha256 of the binary
+	SHA256 string `json:"sha256"`
+}
+
+// updateFile path of es binary for platform in update dir,
+// es-<os>-<arch>, with .exe for windows; manifest is in <path>.manifest,
+// and signature of manifest is in <path>.sig
+func (relay *Relay) updateFile(goos string, goarch string) string {
+	name := "es-" + goos + "-" + goarch
+	if goos == "windows" {
+		name += ".exe"
+	}
+
+	return filepath.Join(relay.updateDir, name)
+}
+
+// updateVersion version of builds in update dir, empty if not available
+func (relay *Relay) updateVersion() string {
+	if relay.updateDir == "" {
+		return ""
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(relay.updateDir, "version"))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
+
+// loadAdvert update advertisement for device, nil if no build for it
+func (relay *Relay) loadAdvert(info *deviceInfo, version string) *updateAdvert {
+	if version == "" || info.version == version ||
+		!validPlatform(info.goos) || !validPlatform(info.goarch) {
+		return nil
+	}
+
+	path := relay.updateFile(info.goos, info.goarch)
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	mb, err := ioutil.ReadFile(path + ".manifest")
+	if err != nil {
+		log.Warnf("loadAdvert no manifest of %s:%v", path, err)
+		return nil
+	}
+
+	// device verify it, check here only to catch mistakes early
+	manifest := &updateManifest{}
+	err = json.Unmarshal(mb, manifest)
+	if err != nil || manifest.Version != version || manifest.OS != info.goos ||
+		manifest.Arch != info.goarch || manifest.Size != st.Size() {
+		log.Warnf("loadAdvert manifest of %s does not match version %s and the binary", path, version)
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(path + ".sig")
+	if err != nil {
+		log.Warnf("loadAdvert no signature of %s:%v", path, err)
+		return nil
+	}
+
+	sig := strings.TrimSpace(string(b))
+	if !validSig(sig) {
+		log.Warnf("loadAdvert invalid signature of %s, need base64 ed25519 signature", path)
+		return nil
+	}
+
+	return &updateAdvert{
+		Version:  version,
+		Manifest: string(mb),
+		Sig:      sig,
+	}
+}
+
+// advertiseUpdate send update advertisement to device, if its version
+// differ from the one in update dir, packet: op(1) + json updateAdvert
+func (relay *Relay) advertiseUpdate(d *Device, version string) {
+	adv := relay.loadAdvert(&d.info, version)
+	if adv == nil {
+		return
+	}
+
+	mb, err := json.Marshal(adv)
+	if err != nil {
+		return
+	}
+
+	log.Printf("advertiseUpdate device %s from %s to %s", d.uuid, d.info.version, adv.Version)
+	d.write(websocket.BinaryMessage, append([]byte{cmdUpdate}, mb...))
+}
+
+// checkUpdate advertise to all devices if version in update dir changed
+func (relay *Relay) checkUpdate() {
+	version := relay.updateVersion()
+
+	relay.devLock.Lock()
+	changed := version != relay.lastUpdateVersion
+	relay.lastUpdateVersion = version
+	relay.devLock.Unlock()
+
+	if !changed || version == "" {
+		return
+	}
+
+	log.Println("checkUpdate new version of endpoint server:", version)
+	relay.devices.each(func(d *Device) {
+		relay.advertiseUpdate(d, version)
+	})
+}
+
+// handleUpdateDownload send es binary for os/arch to device in binary messages,
+// then close normally. version must match current version in update dir
+func (relay *Relay) handleUpdateDownload(c *websocket.Conn, goos string, goarch string, version string) {
+	if version == "" || version != relay.updateVersion() {
+		log.Printf("handleUpdateDownload version %s not available", version)
+		return
+	}
+
+	if !validPlatform(goos) || !validPlatform(goarch) {
+		log.Printf("handleUpdateDownload invalid platform %s-%s", goos, goarch)
+		return
+	}
+
+	path := relay.updateFile(goos, goarch)
+	f, err := os.Open(path)
+	if err != nil {
+		log.Println("handleUpdateDownload open failed:", err)
+		return
+	}
+	defer f.Close()
+
+	log.Printf("handleUpdateDownload %s to %s", path, c.RemoteAddr())
+
+	buf := make([]byte, updateChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if werr := c.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+				log.Println("handleUpdateDownload write failed:", werr)
+				return
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			log.Println("handleUpdateDownload read failed:", err)
+			return
+		}
+	}
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+// validSig check signature file is base64 of 64 bytes
+func validSig(sig string) bool {
+	b, err := base64.StdEncoding.DecodeString(sig)
+	return err == nil && len(b) == 64
+}
+
+// validPlatform check os or arch name, only letters and digits,
+// so that it can not escape update dir
+func validPlatform(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+
+	return true
+}
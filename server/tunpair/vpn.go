@@ -0,0 +1,175 @@
+package tunpair
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// vpnLease addresses of a vpn pair, a /30 network from vpn subnet
+type vpnLease struct {
+	// index of the /30 network in subnet
+	index uint32
+	// endpoint-c address, with prefix length
+	Client string `json:"client"`
+	// device address, with prefix length
+	Device string `json:"device"`
+}
+
+// vpnPool allocate /30 networks from vpn subnet
+type vpnPool struct {
+	lock sync.Mutex
+	// first address of subnet
+	base uint32
+	// count of /30 networks in subnet
+	size uint32
+	used map[uint32]bool
+}
+
+// newVPNPool create vpn pool with ipv4 subnet, nil if invalid
+func newVPNPool(subnet string) *vpnPool {
+	_, n, err := net.ParseCIDR(subnet)
+	if err != nil || n.IP.To4() == nil {
+		log.Warnf("tunpair invalid vpn subnet:%s, vpn disabled", subnet)
+		return nil
+	}
+
+	ones, bits := n.Mask.Size()
+	if bits-ones < 2 {
+		log.Warnf("tunpair vpn subnet:%s too small, vpn disabled", subnet)
+		return nil
+	}
+
+	return &vpnPool{
+		base: binary.BigEndian.Uint32(n.IP.To4()),
+		size: 1 << uint(bits-ones-2),
+		used: make(map[uint32]bool),
+	}
+}
+
+// alloc allocate a /30 network, nil if exhausted
+func (vp *vpnPool) alloc() *vpnLease {
+	vp.lock.Lock()
+	defer vp.lock.Unlock()
+
+	for i := uint32(0); i < vp.size; i++ {
+		if vp.used[i] {
+			continue
+		}
+
+		vp.used[i] = true
+		network := vp.base + i*4
+		return &vpnLease{
+			index:  i,
+			Client: ipv4String(network+1) + "/30",
+			Device: ipv4String(network+2) + "/30",
+		}
+	}
+
+	return nil
+}
+
+// free release the /30 network
+func (vp *vpnPool) free(lease *vpnLease) {
+	vp.lock.Lock()
+	delete(vp.used, lease.index)
+	vp.lock.Unlock()
+}
+
+// ipv4String format uint32 as ipv4 address
+func ipv4String(v uint32) string {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip.String()
+}
+
+// allowVPNClient check if client address is allowed to start vpn pair
+func (relay *Relay) allowVPNClient(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range relay.vpnClients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseVPNClients parse client networks, single address is also allowed
+func parseVPNClients(clients []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range clients {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s = s + "/128"
+			} else {
+				s = s + "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Warnf("tunpair invalid vpn client network:%s, ignore", s)
+			continue
+		}
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// handleVPNRequest endpoint-c request vpn pair to device, addresses are
+// allocated and sent to endpoint-c as json text message before pairing
+func (relay *Relay) handleVPNRequest(c *websocket.Conn, req *pairRequest) {
+	if relay.vpnPool == nil {
+		log.Println("handleVPNRequest vpn not enabled")
+		return
+	}
+
+	if !relay.allowVPNClient(c.RemoteAddr().String()) {
+		log.Warnf("handleVPNRequest client %s not allowed", c.RemoteAddr())
+		return
+	}
+
+	lease := relay.vpnPool.alloc()
+	if lease == nil {
+		log.Println("handleVPNRequest vpn subnet exhausted")
+		return
+	}
+
+	defer relay.vpnPool.free(lease)
+
+	mb, err := json.Marshal(lease)
+	if err != nil {
+		log.Println("handleVPNRequest marshal lease failed:", err)
+		return
+	}
+
+	err = c.WriteMessage(websocket.TextMessage, mb)
+	if err != nil {
+		log.Println("handleVPNRequest write lease failed:", err)
+		return
+	}
+
+	log.Printf("handleVPNRequest client %s(%s) to device %s(%s)",
+		c.RemoteAddr(), lease.Client, req.uuid, lease.Device)
+
+	req.kind = pairKindVPN
+	req.vpn = lease
+	relay.handlePairRequest(c, req)
+}
@@ -17,8 +17,13 @@ type SizeInfo struct {
 }
 
 // webSSHHandler handle web-ssh websocket(from web-browser) connection
-func webSSHHandler(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+func (s *Server) webSSHHandler(w http.ResponseWriter, r *http.Request) {
+	if s.isDraining() {
+		http.Error(w, "server is going away", http.StatusServiceUnavailable)
+		return
+	}
+
+	c, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
@@ -26,11 +31,10 @@ func webSSHHandler(w http.ResponseWriter, r *http.Request) {
 	// ensure websocket will be closed final
 	defer c.Close()
 
-	wsh := newHolder(c)
 	// save to map for keepalive
-	wsmap[wsh.id] = wsh
+	wsh := s.addHolder(c)
 
-	defer delete(wsmap, wsh.id)
+	defer s.removeHolder(wsh)
 
 	// Create arbitrary command.
 	cmd := exec.Command("bash")
@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package server
+
+import (
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// webSSHHandler this platform not support web ssh
+func (s *Server) webSSHHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("this platform not support web ssh")
+	http.Error(w, "web ssh not supported", http.StatusNotImplemented)
+}
@@ -7,6 +7,6 @@ import (
 )
 
 // webSSHHandler windows not support ssh
-func webSSHHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) webSSHHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("windows not support web ssh")
 }
@@ -0,0 +1,13 @@
+// Package tun create layer-3 tun interface, so that ip packets
+// can be carried over pair stream
+package tun
+
+import (
+	"errors"
+)
+
+// MTU of tun interface, leave room for websocket framing
+const MTU = 1400
+
+// ErrNotSupported tun interface not supported on this platform
+var ErrNotSupported = errors.New("tun interface not supported on this platform")
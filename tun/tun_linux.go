@@ -0,0 +1,107 @@
+package tun
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	cIFFTUN   = 0x0001
+	cIFFNOPI  = 0x1000
+	cTUNSETIF = 0x400454ca
+)
+
+// ifReq struct ifreq, for TUNSETIFF
+type ifReq struct {
+	Name  [16]byte
+	Flags uint16
+	pad   [22]byte
+}
+
+// Device tun interface, each Read/Write is one ip packet
+type Device struct {
+	name string
+	file *os.File
+}
+
+// Open create tun interface, name may contain %d, eg. lxvpn%d
+func Open(name string) (*Device, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var req ifReq
+	copy(req.Name[:], name)
+	req.Flags = cIFFTUN | cIFFNOPI
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), cTUNSETIF, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("create tun %s failed: %v", name, errno)
+	}
+
+	// non-blocking, so that Close can interrupt Read
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	d := &Device{
+		name: strings.TrimRight(string(req.Name[:]), "\x00"),
+		file: os.NewFile(uintptr(fd), "/dev/net/tun"),
+	}
+
+	return d, nil
+}
+
+// Name interface name
+func (d *Device) Name() string {
+	return d.name
+}
+
+// Read read one ip packet
+func (d *Device) Read(b []byte) (int, error) {
+	return d.file.Read(b)
+}
+
+// Write write one ip packet
+func (d *Device) Write(b []byte) (int, error) {
+	return d.file.Write(b)
+}
+
+// Close close and remove the interface
+func (d *Device) Close() error {
+	return d.file.Close()
+}
+
+// Up assign address(with prefix length) to interface and bring it up
+func (d *Device) Up(addr string) error {
+	err := ip("addr", "add", addr, "dev", d.name)
+	if err != nil {
+		return err
+	}
+
+	return ip("link", "set", "dev", d.name, "mtu", strconv.Itoa(MTU), "up")
+}
+
+// AddRoute route network via the interface
+func (d *Device) AddRoute(network string) error {
+	return ip("route", "add", network, "dev", d.name)
+}
+
+// ip run ip command
+func ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s failed: %v, %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package tun
+
+// Device tun interface, not supported on this platform
+type Device struct {
+}
+
+// Open not supported on this platform
+func Open(name string) (*Device, error) {
+	return nil, ErrNotSupported
+}
+
+// Name interface name
+func (d *Device) Name() string {
+	return ""
+}
+
+// Read not supported on this platform
+func (d *Device) Read(b []byte) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// Write not supported on this platform
+func (d *Device) Write(b []byte) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// Close not supported on this platform
+func (d *Device) Close() error {
+	return ErrNotSupported
+}
+
+// Up not supported on this platform
+func (d *Device) Up(addr string) error {
+	return ErrNotSupported
+}
+
+// AddRoute not supported on this platform
+func (d *Device) AddRoute(network string) error {
+	return ErrNotSupported
+}
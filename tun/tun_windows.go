@@ -0,0 +1,40 @@
+package tun
+
+// Device tun interface, not supported on windows
+type Device struct {
+}
+
+// Open not supported on windows
+func Open(name string) (*Device, error) {
+	return nil, ErrNotSupported
+}
+
+// Name interface name
+func (d *Device) Name() string {
+	return ""
+}
+
+// Read not supported on windows
+func (d *Device) Read(b []byte) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// Write not supported on windows
+func (d *Device) Write(b []byte) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// Close not supported on windows
+func (d *Device) Close() error {
+	return ErrNotSupported
+}
+
+// Up not supported on windows
+func (d *Device) Up(addr string) error {
+	return ErrNotSupported
+}
+
+// AddRoute not supported on windows
+func (d *Device) AddRoute(network string) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,85 @@
+// Package upgrade zero-downtime binary upgrade, the new process inherit
+// listening sockets from old process, old process keep serving existing
+// connections until they end
+package upgrade
+
+import (
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// envListenFDs inherited listeners, name=fd separated by comma
+	envListenFDs = "LXPORT_LISTEN_FDS"
+	// envReadyFD fd number of pipe, that new process write to when ready
+	envReadyFD = "LXPORT_READY_FD"
+)
+
+// listeners created by Listen, handed to new process by Upgrade
+var (
+	listenerLock sync.Mutex
+	listeners    = make(map[string]net.Listener)
+)
+
+// Inherited return true if current process is started by Upgrade
+func Inherited() bool {
+	return os.Getenv(envListenFDs) != ""
+}
+
+// Listen return listener of name inherited from old process if current
+// process is started by Upgrade, otherwise listen on address. Listeners
+// are handed to new process by Upgrade with their names
+func Listen(name string, network string, address string) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if fds := inheritedFDs(); fds[name] != "" {
+		l, err = inheritedListener(name, fds[name])
+	} else {
+		l, err = net.Listen(network, address)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	listenerLock.Lock()
+	listeners[name] = l
+	listenerLock.Unlock()
+
+	return l, nil
+}
+
+// inheritedFDs names and fd numbers of inherited listeners
+func inheritedFDs() map[string]string {
+	fds := make(map[string]string)
+	for _, kv := range strings.Split(os.Getenv(envListenFDs), ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && parts[0] != "" {
+			fds[parts[0]] = parts[1]
+		}
+	}
+
+	return fds
+}
+
+// namedListeners listeners created by Listen, sorted by name
+func namedListeners() ([]string, []net.Listener) {
+	listenerLock.Lock()
+	defer listenerLock.Unlock()
+
+	var names []string
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ls []net.Listener
+	for _, name := range names {
+		ls = append(ls, listeners[name])
+	}
+
+	return names, ls
+}
@@ -0,0 +1,161 @@
+package upgrade
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fd number of extra files in new process, after stdin/stdout/stderr,
+// listeners follow the ready pipe
+const readyFD = 3
+
+// inheritedListener build listener of name from inherited fd
+func inheritedListener(name string, fdStr string) (net.Listener, error) {
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fd of listener %s: %v", name, err)
+	}
+
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("upgrade inherit listener %s:%s", name, l.Addr())
+	return l, nil
+}
+
+// Ready tell old process that current process is ready to serve, call
+// it after all listeners created. Do nothing if current process is not
+// started by Upgrade
+func Ready() {
+	fdStr := os.Getenv(envReadyFD)
+	if fdStr == "" {
+		return
+	}
+
+	// close inherited listeners that not used any more
+	listenerLock.Lock()
+	for name, fd := range inheritedFDs() {
+		if _, ok := listeners[name]; ok {
+			continue
+		}
+
+		if n, err := strconv.Atoi(fd); err == nil {
+			log.Printf("upgrade close unused listener:%s", name)
+			os.NewFile(uintptr(n), name).Close()
+		}
+	}
+	listenerLock.Unlock()
+
+	os.Unsetenv(envReadyFD)
+	os.Unsetenv(envListenFDs)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		log.Errorf("upgrade invalid %s: %v", envReadyFD, err)
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// Upgrade start new process with the same executable and arguments,
+// and hand listeners created by Listen to it. Return nil after new
+// process is ready, then old process should stop accepting and drain
+// existing connections
+func Upgrade(timeout time.Duration) error {
+	names, ls := namedListeners()
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var fds []string
+	for i, l := range ls {
+		fl, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return fmt.Errorf("listener %s %T can not be inherited", names[i], l)
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, f)
+		fds = append(fds, fmt.Sprintf("%s=%d", names[i], readyFD+1+i))
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append([]*os.File{pw}, files...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", envListenFDs, strings.Join(fds, ",")),
+		fmt.Sprintf("%s=%d", envReadyFD, readyFD))
+
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("upgrade new process started, pid:%d, wait it ready", cmd.Process.Pid)
+
+	// new process write one byte when ready, or EOF if it exits
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := io.ReadFull(pr, b)
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = fmt.Errorf("timeout")
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return fmt.Errorf("upgrade new process not ready: %v", err)
+	}
+
+	// new process is not child that we wait for
+	go cmd.Wait()
+
+	log.Printf("upgrade new process ready, pid:%d", cmd.Process.Pid)
+	return nil
+}
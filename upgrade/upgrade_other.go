@@ -0,0 +1,24 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package upgrade
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// inheritedListener this platform not support listener handover
+func inheritedListener(_ string, _ string) (net.Listener, error) {
+	return nil, fmt.Errorf("this platform not support inherit listener")
+}
+
+// Ready this platform not support upgrade, do nothing
+func Ready() {
+}
+
+// Upgrade this platform not support upgrade
+func Upgrade(_ time.Duration) error {
+	return fmt.Errorf("this platform not support upgrade")
+}
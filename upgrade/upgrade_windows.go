@@ -0,0 +1,21 @@
+package upgrade
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// inheritedListener windows not support listener handover
+func inheritedListener(_ string, _ string) (net.Listener, error) {
+	return nil, fmt.Errorf("windows not support inherit listener")
+}
+
+// Ready windows not support upgrade, do nothing
+func Ready() {
+}
+
+// Upgrade windows not support upgrade
+func Upgrade(_ time.Duration) error {
+	return fmt.Errorf("windows not support upgrade")
+}
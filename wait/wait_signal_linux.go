@@ -7,11 +7,12 @@ import (
 	"syscall"
 )
 
-// GetSignal get signal
-func GetSignal() {
+// GetSignal get signal, return the signal that should stop(or upgrade) the process
+func GetSignal() os.Signal {
 	for {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGUSR1, syscall.SIGUSR2)
+		signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP,
+			syscall.SIGUSR1, syscall.SIGUSR2)
 
 		// Block until a signal is received.
 		s := <-c
@@ -27,6 +28,11 @@ func GetSignal() {
 			continue
 		}
 
-		break
+		return s
 	}
 }
+
+// IsUpgrade return true if the signal ask process to upgrade
+func IsUpgrade(s os.Signal) bool {
+	return s == syscall.SIGHUP
+}
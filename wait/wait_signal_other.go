@@ -0,0 +1,27 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package wait
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+)
+
+// GetSignal get signal, return the signal that should stop the process
+func GetSignal() os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, os.Kill)
+
+	// Block until a signal is received.
+	s := <-c
+	fmt.Println("Got signal:", s)
+
+	return s
+}
+
+// IsUpgrade this platform not support upgrade
+func IsUpgrade(_ os.Signal) bool {
+	return false
+}
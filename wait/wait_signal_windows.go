@@ -6,8 +6,8 @@ import (
 	"os/signal"
 )
 
-// GetSignal get signal
-func GetSignal() {
+// GetSignal get signal, return the signal that should stop the process
+func GetSignal() os.Signal {
 	for {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, os.Kill)
@@ -21,6 +21,11 @@ func GetSignal() {
 			dumpGoRoutinesInfo()
 		}
 
-		break
+		return s
 	}
 }
+
+// IsUpgrade windows not support upgrade
+func IsUpgrade(_ os.Signal) bool {
+	return false
+}
@@ -0,0 +1,206 @@
+// Package wsconn adapt websocket connection to net.Conn,
+// so that pair stream can be used as an ordinary stream connection
+package wsconn
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn websocket connection as net.Conn,
+// each Write is sent as one binary message
+type Conn struct {
+	ws *websocket.Conn
+	// protect websocket conn cocurrently writing
+	writeLock sync.Mutex
+
+	// remaining bytes of current message
+	pending []byte
+
+	closeOnce sync.Once
+	onClose   func()
+}
+
+// New create Conn from websocket connection
+func New(ws *websocket.Conn) *Conn {
+	return &Conn{
+		ws: ws,
+	}
+}
+
+// NewWithCloser create Conn, onClose will be called once when Conn closed
+func NewWithCloser(ws *websocket.Conn, onClose func()) *Conn {
+	return &Conn{
+		ws:      ws,
+		onClose: onClose,
+	}
+}
+
+// WS underlying websocket connection
+func (c *Conn) WS() *websocket.Conn {
+	return c.ws
+}
+
+// Read read data from websocket messages
+func (c *Conn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		_, message, err := c.ws.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); ok {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+
+		c.pending = message
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// ReadMessage read one whole message, must not mix with Read
+func (c *Conn) ReadMessage() ([]byte, error) {
+	_, message, err := c.ws.ReadMessage()
+	if err != nil {
+		if _, ok := err.(*websocket.CloseError); ok {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// Write write data as one binary message
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	err := c.ws.WriteMessage(websocket.BinaryMessage, b)
+	c.writeLock.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// WriteMessage write message with type, concurrently safe with Write
+func (c *Conn) WriteMessage(mt int, data []byte) error {
+	c.writeLock.Lock()
+	err := c.ws.WriteMessage(mt, data)
+	c.writeLock.Unlock()
+
+	return err
+}
+
+// Close close underlying websocket connection
+func (c *Conn) Close() error {
+	err := c.ws.Close()
+	c.closeOnce.Do(func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+
+	return err
+}
+
+// LocalAddr local network address
+func (c *Conn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+// RemoteAddr remote network address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+// SetDeadline set read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	err := c.ws.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.ws.SetWriteDeadline(t)
+}
+
+// SetReadDeadline set read deadline
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+// SetWriteDeadline set write deadline
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// Bridge copy data between two connections in both directions,
+// return when either direction finished, and both are closed
+func Bridge(a net.Conn, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+
+	go cp(a, b)
+	go cp(b, a)
+
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// BridgePackets copy packets between websocket and packet device, eg. tun,
+// that each Read/Write is one packet; packets from websocket are dropped
+// if allow returns false. Return when either direction finished
+func BridgePackets(c *Conn, dev io.ReadWriteCloser, mtu int, allow func(packet []byte) bool) {
+	done := make(chan struct{}, 2)
+
+	go func() {
+		b := make([]byte, mtu)
+		for {
+			n, err := dev.Read(b)
+			if err != nil {
+				break
+			}
+
+			if _, err := c.Write(b[:n]); err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+
+	go func() {
+		for {
+			packet, err := c.ReadMessage()
+			if err != nil {
+				break
+			}
+
+			if allow != nil && !allow(packet) {
+				continue
+			}
+
+			if _, err := dev.Write(packet); err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+
+	<-done
+	c.Close()
+	dev.Close()
+	<-done
+}
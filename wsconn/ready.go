@@ -0,0 +1,42 @@
+package wsconn
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrNotReady server send unexpected message instead of ready notification
+var ErrNotReady = errors.New("unexpected message, pair not ready")
+
+// WaitReady wait server's ready notification of a pair websocket,
+// that is dialed with ready=1. The websocket is closed if not ready
+func WaitReady(ctx context.Context, ws *websocket.Conn) error {
+	// server close the websocket if pair failed
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	mt, message, err := ws.ReadMessage()
+	if err != nil {
+		ws.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	if mt != websocket.TextMessage || string(message) != "ok" {
+		ws.Close()
+		return ErrNotReady
+	}
+
+	return nil
+}